@@ -0,0 +1,497 @@
+// Package config loads the settings shared by the server & reactor.
+//
+// Settings are layered, each overriding the last:
+//
+//  1. Defaults
+//  2. A YAML or TOML file, given by `--config` or `CONFIG_FILE`
+//  3. Environment variables
+//  4. Flags
+//
+// Every setting has an environment variable (its `env` tag) and a flag, named
+// after the environment variable in lower kebab-case (ie. `NATS_URL` is
+// `--nats-url`).
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+//------------------------------------------------------------------------------
+
+type Config struct {
+	Debug bool `yaml:"debug" toml:"debug" env:"DEBUG" usage:"Enable debug logging"`
+
+	Nats     NatsConfig     `yaml:"nats" toml:"nats"`
+	Streams  StreamsConfig  `yaml:"streams" toml:"streams"`
+	Buckets  BucketsConfig  `yaml:"buckets" toml:"buckets"`
+	Timeouts TimeoutsConfig `yaml:"timeouts" toml:"timeouts"`
+	Server   ServerConfig   `yaml:"server" toml:"server"`
+	Reactor  ReactorConfig  `yaml:"reactor" toml:"reactor"`
+	Migrate  MigrateConfig  `yaml:"migrate" toml:"migrate"`
+
+	ReadModel ReadModelConfig `yaml:"read_model" toml:"read_model"`
+
+	// File is the config file that was loaded, if any
+	File string `yaml:"-" toml:"-"`
+	// PrintConfig is set when the effective config should be printed, instead
+	// of running
+	PrintConfig bool `yaml:"-" toml:"-"`
+}
+
+// NatsConfig describes how to connect to the NATS cluster
+type NatsConfig struct {
+	URLs     string `yaml:"urls" toml:"urls" env:"NATS_URL" usage:"Comma-separated list of NATS server URLs"`
+	User     string `yaml:"user" toml:"user" env:"NATS_USER" usage:"NATS username"`
+	Password string `yaml:"password" toml:"password" env:"NATS_PASSWORD" usage:"NATS password"`
+	// CredsFile is a `.creds` file, containing a user JWT & nkey seed
+	CredsFile string `yaml:"creds_file" toml:"creds_file" env:"NATS_CREDS" usage:"NATS .creds file"`
+	// NkeySeedFile is a file containing a user nkey seed
+	NkeySeedFile string `yaml:"nkey_seed_file" toml:"nkey_seed_file" env:"NATS_NKEY" usage:"NATS nkey seed file"`
+
+	// TLSCert & TLSKey are a client certificate, for mutual TLS
+	TLSCert string `yaml:"tls_cert" toml:"tls_cert" env:"NATS_TLS_CERT" usage:"Client certificate for NATS mutual TLS"`
+	TLSKey  string `yaml:"tls_key" toml:"tls_key" env:"NATS_TLS_KEY" usage:"Client key for NATS mutual TLS"`
+	// TLSCA is the CA to verify the server against, instead of the system pool
+	TLSCA string `yaml:"tls_ca" toml:"tls_ca" env:"NATS_TLS_CA" usage:"CA to verify the NATS server against"`
+
+	ConnectTimeout time.Duration `yaml:"connect_timeout" toml:"connect_timeout" env:"NATS_CONNECT_TIMEOUT" usage:"Timeout for connecting to a NATS server"`
+	// MaxReconnects is how many reconnect attempts are made per server before
+	// giving up, or -1 to keep trying forever
+	MaxReconnects   int           `yaml:"max_reconnects" toml:"max_reconnects" env:"NATS_MAX_RECONNECTS" usage:"Reconnect attempts per NATS server (-1 for unlimited)"`
+	ReconnectWait   time.Duration `yaml:"reconnect_wait" toml:"reconnect_wait" env:"NATS_RECONNECT_WAIT" usage:"Delay between NATS reconnect attempts"`
+	ReconnectJitter time.Duration `yaml:"reconnect_jitter" toml:"reconnect_jitter" env:"NATS_RECONNECT_JITTER" usage:"Random jitter added to the NATS reconnect delay"`
+}
+
+// StreamsConfig names the JetStream streams
+type StreamsConfig struct {
+	Commands      string `yaml:"commands" toml:"commands" env:"STREAM_COMMANDS" usage:"Name of the commands stream"`
+	Events        string `yaml:"events" toml:"events" env:"STREAM_EVENTS" usage:"Name of the events stream"`
+	Notifications string `yaml:"notifications" toml:"notifications" env:"STREAM_NOTIFICATIONS" usage:"Name of the notifications stream"`
+	// NotificationsMaxAge is how long notifications are kept for SSE clients
+	// to catch up on
+	NotificationsMaxAge time.Duration `yaml:"notifications_max_age" toml:"notifications_max_age" env:"STREAM_NOTIFICATIONS_MAX_AGE" usage:"How long notifications are retained"`
+	DeadLetter          string        `yaml:"dead_letter" toml:"dead_letter" env:"STREAM_DEAD_LETTER" usage:"Name of the dead-letter stream"`
+	// DeadLetterMaxAge is how long dead-lettered messages are kept, or 0 to
+	// keep them until they are dealt with
+	DeadLetterMaxAge time.Duration `yaml:"dead_letter_max_age" toml:"dead_letter_max_age" env:"STREAM_DEAD_LETTER_MAX_AGE" usage:"How long dead-lettered messages are retained (0 is forever)"`
+	// DuplicateWindow is how long message ids are tracked to drop duplicates
+	DuplicateWindow time.Duration `yaml:"duplicate_window" toml:"duplicate_window" env:"STREAM_DUPLICATE_WINDOW" usage:"How long message ids are tracked for de-duplication"`
+	// Replicas & Storage apply to every stream & KV bucket
+	Replicas int    `yaml:"replicas" toml:"replicas" env:"STREAM_REPLICAS" usage:"Replicas of every stream & bucket"`
+	Storage  string `yaml:"storage" toml:"storage" env:"STREAM_STORAGE" usage:"Storage of every stream & bucket (file or memory)"`
+}
+
+// BucketsConfig names the JetStream KV buckets
+type BucketsConfig struct {
+	Locations        string `yaml:"locations" toml:"locations" env:"BUCKET_LOCATIONS" usage:"Name of the locations read model bucket"`
+	LocationsHistory uint8  `yaml:"locations_history" toml:"locations_history" env:"BUCKET_LOCATIONS_HISTORY" usage:"Revisions kept per location"`
+	LocationNames    string `yaml:"location_names" toml:"location_names" env:"BUCKET_LOCATION_NAMES" usage:"Name of the location name index bucket"`
+	IdempotencyKeys  string `yaml:"idempotency_keys" toml:"idempotency_keys" env:"BUCKET_IDEMPOTENCY_KEYS" usage:"Name of the idempotency keys bucket"`
+	// IdempotencyKeyTTL is how long an Idempotency-Key is remembered for
+	IdempotencyKeyTTL time.Duration `yaml:"idempotency_key_ttl" toml:"idempotency_key_ttl" env:"BUCKET_IDEMPOTENCY_KEY_TTL" usage:"How long idempotency keys are remembered"`
+	// ReadModels records which bucket each read model is served from
+	ReadModels string `yaml:"read_models" toml:"read_models" env:"BUCKET_READ_MODELS" usage:"Name of the bucket recording the active read model buckets"`
+	// Projections records which commands have been projected, for as long as
+	// ProjectionsTTL
+	Projections    string        `yaml:"projections" toml:"projections" env:"BUCKET_PROJECTIONS" usage:"Name of the bucket recording projected commands"`
+	ProjectionsTTL time.Duration `yaml:"projections_ttl" toml:"projections_ttl" env:"BUCKET_PROJECTIONS_TTL" usage:"How long projected commands are remembered"`
+	// Topology records the version of the topology that was last migrated to
+	Topology string `yaml:"topology" toml:"topology" env:"BUCKET_TOPOLOGY" usage:"Name of the bucket recording the migrated topology version"`
+}
+
+type TimeoutsConfig struct {
+	// Publish bounds publishing a message, or any other single NATS request
+	Publish time.Duration `yaml:"publish" toml:"publish" env:"TIMEOUT_PUBLISH" usage:"Timeout for publishing to NATS"`
+	// Query bounds reading the read model or a stream to answer a request, and
+	// cleaning up after a command that could not be published
+	Query time.Duration `yaml:"query" toml:"query" env:"TIMEOUT_QUERY" usage:"Timeout for queries & lookups"`
+	// Setup bounds creating, checking or migrating a stream, KV bucket or consumer
+	Setup time.Duration `yaml:"setup" toml:"setup" env:"TIMEOUT_SETUP" usage:"Timeout for creating streams, buckets & consumers"`
+	// Shutdown bounds shutting down gracefully
+	Shutdown time.Duration `yaml:"shutdown" toml:"shutdown" env:"TIMEOUT_SHUTDOWN" usage:"Deadline for shutting down gracefully"`
+}
+
+// Stores that the locations read model can be kept in
+const (
+	ReadModelStoreKv       = "kv"
+	ReadModelStoreSqlite   = "sqlite"
+	ReadModelStorePostgres = "postgres"
+)
+
+// ReadModelConfig describes where the locations read model is kept - the
+// locations bucket, or a SQL database
+type ReadModelConfig struct {
+	Store string `yaml:"store" toml:"store" env:"READ_MODEL_STORE" usage:"Where the locations read model is kept (kv, sqlite or postgres)"`
+	// DSN is the data source name of the SQL database, ie.
+	// `file:locations.db?_pragma=busy_timeout(5000)` or `postgres://...`
+	DSN          string `yaml:"dsn" toml:"dsn" env:"READ_MODEL_DSN" usage:"Data source name of the SQL read model database"`
+	MaxOpenConns int    `yaml:"max_open_conns" toml:"max_open_conns" env:"READ_MODEL_MAX_OPEN_CONNS" usage:"Maximum open connections to the SQL read model database"`
+}
+
+// Sql reports whether the read model is kept in a SQL database
+func (c ReadModelConfig) Sql() bool {
+	return c.Store == ReadModelStoreSqlite || c.Store == ReadModelStorePostgres
+}
+
+type MigrateConfig struct {
+	// DryRun only prints the changes that would be made
+	DryRun bool `yaml:"dry_run" toml:"dry_run" env:"MIGRATE_DRY_RUN" usage:"Print the pending topology changes & schema migrations without applying them"`
+	// Force allows destructive changes, ie. recreating a stream
+	Force bool `yaml:"force" toml:"force" env:"MIGRATE_FORCE" usage:"Apply destructive topology changes"`
+}
+
+type ServerConfig struct {
+	Addr string `yaml:"addr" toml:"addr" env:"SERVE_ADDR" usage:"Address to serve HTTP on"`
+	// AwaitTimeout is how long a request awaits its notification, unless it
+	// asks for something else
+	AwaitTimeout time.Duration `yaml:"await_timeout" toml:"await_timeout" env:"SERVER_AWAIT_TIMEOUT" usage:"Default time to await a notification"`
+	// NotificationStreamTTL is how long an idle SSE stream is kept around
+	NotificationStreamTTL time.Duration `yaml:"notification_stream_ttl" toml:"notification_stream_ttl" env:"SERVER_NOTIFICATION_STREAM_TTL" usage:"How long idle SSE streams are kept"`
+	// ConsistencyTimeout is how long a query with a consistency token waits for
+	// the read model to catch up, polling every ConsistencyPollInterval
+	ConsistencyTimeout      time.Duration `yaml:"consistency_timeout" toml:"consistency_timeout" env:"SERVER_CONSISTENCY_TIMEOUT" usage:"How long queries wait for the read model to reach their consistency token"`
+	ConsistencyPollInterval time.Duration `yaml:"consistency_poll_interval" toml:"consistency_poll_interval" env:"SERVER_CONSISTENCY_POLL_INTERVAL" usage:"How often the read model is checked while waiting"`
+	// ListLimit is the page size of GET /location, unless it asks for another
+	// of up to ListMaxLimit
+	ListLimit    int `yaml:"list_limit" toml:"list_limit" env:"SERVER_LIST_LIMIT" usage:"Default number of locations per page"`
+	ListMaxLimit int `yaml:"list_max_limit" toml:"list_max_limit" env:"SERVER_LIST_MAX_LIMIT" usage:"Maximum number of locations per page"`
+	// CacheReadModel serves queries from an in-memory copy of the read model,
+	// kept current by a watcher. It only applies to the kv store.
+	CacheReadModel bool `yaml:"cache_read_model" toml:"cache_read_model" env:"SERVER_CACHE_READ_MODEL" usage:"Serve queries from an in-memory copy of the read model"`
+	// SessionSecret signs session tokens. It must be shared by every server
+	// instance - without it, a random one is used per process.
+	SessionSecret string `yaml:"session_secret" toml:"session_secret" env:"SERVER_SESSION_SECRET" usage:"Secret that session tokens are signed with"`
+}
+
+type ReactorConfig struct {
+	// CommandsConsumer & ProjectorConsumer name the durable consumers
+	CommandsConsumer  string         `yaml:"commands_consumer" toml:"commands_consumer" env:"REACTOR_COMMANDS_CONSUMER" usage:"Name of the durable commands consumer"`
+	ProjectorConsumer string         `yaml:"projector_consumer" toml:"projector_consumer" env:"REACTOR_PROJECTOR_CONSUMER" usage:"Name of the durable projector consumer"`
+	Consumer          ConsumerConfig `yaml:"consumer" toml:"consumer"`
+	// Partitions is how many partitions the commands & events streams are split
+	// into by aggregate id, each with its own durable consumers. It is fixed
+	// once the streams hold messages, as an aggregate's history must stay in
+	// one partition.
+	Partitions int `yaml:"partitions" toml:"partitions" env:"REACTOR_PARTITIONS" usage:"Partitions the commands & events streams are split into"`
+	// Instances is how many reactor instances share the partitions, and
+	// Instance is the (zero-based) index of this one
+	Instances int `yaml:"instances" toml:"instances" env:"REACTOR_INSTANCES" usage:"Number of reactor instances sharing the partitions"`
+	Instance  int `yaml:"instance" toml:"instance" env:"REACTOR_INSTANCE" usage:"Zero-based index of this reactor instance"`
+
+	Rebuild RebuildConfig `yaml:"rebuild" toml:"rebuild"`
+}
+
+// RebuildConfig describes rebuilding the locations read model into a fresh
+// bucket, which the reactor does instead of consuming when Run is set
+type RebuildConfig struct {
+	Run bool `yaml:"run" toml:"run" env:"REBUILD_RUN" usage:"Rebuild the locations read model, instead of running the reactor"`
+	// Bucket defaults to the next version of the active bucket, ie.
+	// `locations_v2`
+	Bucket string `yaml:"bucket" toml:"bucket" env:"REBUILD_BUCKET" usage:"Bucket to rebuild the read model into (defaults to the next version)"`
+	// FromSequence & FromTime replay from part way through the events stream,
+	// rather than from the start, into a copy of the active bucket
+	FromSequence uint64 `yaml:"from_sequence" toml:"from_sequence" env:"REBUILD_FROM_SEQUENCE" usage:"Events stream sequence to replay from"`
+	FromTime     string `yaml:"from_time" toml:"from_time" env:"REBUILD_FROM_TIME" usage:"Time (RFC 3339) to replay events from"`
+	// Notify sends notifications for the replayed events, which are suppressed
+	// otherwise
+	Notify           bool          `yaml:"notify" toml:"notify" env:"REBUILD_NOTIFY" usage:"Send notifications for replayed events"`
+	ProgressInterval time.Duration `yaml:"progress_interval" toml:"progress_interval" env:"REBUILD_PROGRESS_INTERVAL" usage:"How often rebuild progress is logged"`
+	// Settle is how long the live projector is given to notice the switch
+	// over, before the rebuild catches up with it & stops
+	Settle time.Duration `yaml:"settle" toml:"settle" env:"REBUILD_SETTLE" usage:"Time for the live projector to notice the switch over"`
+}
+
+// ConsumerConfig tunes how messages are pulled from the durable consumers
+type ConsumerConfig struct {
+	BatchSize        int           `yaml:"batch_size" toml:"batch_size" env:"CONSUMER_BATCH_SIZE" usage:"Messages buffered by the client"`
+	MaxInFlight      int           `yaml:"max_in_flight" toml:"max_in_flight" env:"CONSUMER_MAX_IN_FLIGHT" usage:"Messages delivered but not yet acked"`
+	AckWait          time.Duration `yaml:"ack_wait" toml:"ack_wait" env:"CONSUMER_ACK_WAIT" usage:"Time before an unacked message is redelivered"`
+	Heartbeat        time.Duration `yaml:"heartbeat" toml:"heartbeat" env:"CONSUMER_HEARTBEAT" usage:"Idle heartbeat - two missed ones resubscribe"`
+	ResubscribeDelay time.Duration `yaml:"resubscribe_delay" toml:"resubscribe_delay" env:"CONSUMER_RESUBSCRIBE_DELAY" usage:"Delay before resubscribing after an error"`
+	MaxDeliver       int           `yaml:"max_deliver" toml:"max_deliver" env:"CONSUMER_MAX_DELIVER" usage:"Attempts before a message is dead-lettered"`
+	RetryBackoff     time.Duration `yaml:"retry_backoff" toml:"retry_backoff" env:"CONSUMER_RETRY_BACKOFF" usage:"Delay before the first retry, doubling each time"`
+	RetryBackoffMax  time.Duration `yaml:"retry_backoff_max" toml:"retry_backoff_max" env:"CONSUMER_RETRY_BACKOFF_MAX" usage:"Upper bound of the retry delay"`
+	RetryInPlace     time.Duration `yaml:"retry_in_place" toml:"retry_in_place" env:"CONSUMER_RETRY_IN_PLACE" usage:"How long to retry in place before redelivering"`
+	Workers          int           `yaml:"workers" toml:"workers" env:"CONSUMER_WORKERS" usage:"Messages handled concurrently"`
+}
+
+// Default is the config used for local development
+func Default() Config {
+	return Config{
+		Nats: NatsConfig{
+			URLs:            "nats://127.0.0.1:4222",
+			ConnectTimeout:  2 * time.Second,
+			MaxReconnects:   -1,
+			ReconnectWait:   2 * time.Second,
+			ReconnectJitter: 100 * time.Millisecond,
+		},
+		Streams: StreamsConfig{
+			Commands:            "all",
+			Events:              "events",
+			Notifications:       "notifications",
+			NotificationsMaxAge: 24 * time.Hour,
+			DeadLetter:          "deadletter",
+			DuplicateWindow:     2 * time.Minute,
+			Replicas:            1,
+			Storage:             "file",
+		},
+		Buckets: BucketsConfig{
+			Locations:         "locations",
+			LocationsHistory:  20,
+			LocationNames:     "location_names",
+			IdempotencyKeys:   "idempotency_keys",
+			IdempotencyKeyTTL: 24 * time.Hour,
+			ReadModels:        "read_models",
+			Projections:       "projections",
+			ProjectionsTTL:    24 * time.Hour,
+			Topology:          "topology",
+		},
+		Timeouts: TimeoutsConfig{
+			Publish:  2 * time.Second,
+			Query:    2 * time.Second,
+			Setup:    5 * time.Second,
+			Shutdown: 30 * time.Second,
+		},
+		Server: ServerConfig{
+			Addr:                    ":3000",
+			AwaitTimeout:            2 * time.Second,
+			NotificationStreamTTL:   time.Minute,
+			ConsistencyTimeout:      2 * time.Second,
+			ConsistencyPollInterval: 100 * time.Millisecond,
+			ListLimit:               100,
+			ListMaxLimit:            1000,
+			CacheReadModel:          true,
+		},
+		Reactor: ReactorConfig{
+			CommandsConsumer:  "reactor",
+			ProjectorConsumer: "projector",
+			Consumer: ConsumerConfig{
+				BatchSize:        100,
+				MaxInFlight:      1000,
+				AckWait:          30 * time.Second,
+				Heartbeat:        5 * time.Second,
+				ResubscribeDelay: 1 * time.Second,
+				MaxDeliver:       5,
+				RetryBackoff:     1 * time.Second,
+				RetryBackoffMax:  1 * time.Minute,
+				RetryInPlace:     5 * time.Second,
+				Workers:          4,
+			},
+			Partitions: 8,
+			Instances:  1,
+			Rebuild: RebuildConfig{
+				ProgressInterval: 5 * time.Second,
+				Settle:           5 * time.Second,
+			},
+		},
+		ReadModel: ReadModelConfig{
+			Store:        ReadModelStoreKv,
+			MaxOpenConns: 10,
+		},
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// Load builds the config from the layers, parsing the command-line arguments
+// (ie. `os.Args[1:]`) as flags. The config is returned even if it is invalid,
+// so that the error can be logged with it.
+func Load(name string, args []string) (*Config, error) {
+	var (
+		cfg       = Default()
+		defaults  = Default()
+		fs        = flag.NewFlagSet(name, flag.ExitOnError)
+		overrides = map[string]string{}
+	)
+
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file")
+	printConfig := fs.Bool("print-config", false, "Print the effective config and exit")
+
+	err := visitFields(&defaults, func(f field) error {
+		fs.Var(&flagValue{field: f, overrides: overrides}, f.flagName(), f.usage)
+		return nil
+	})
+	if err != nil {
+		return &cfg, err
+	}
+
+	// Exits on failure
+	_ = fs.Parse(args)
+
+	cfg.File = *file
+	cfg.PrintConfig = *printConfig
+
+	if cfg.File != "" {
+		err = loadFile(cfg.File, &cfg)
+		if err != nil {
+			return &cfg, fmt.Errorf("failed to load config file %s: %w", cfg.File, err)
+		}
+	}
+
+	err = visitFields(&cfg, func(f field) error {
+		if raw, ok := os.LookupEnv(f.env); ok && raw != "" {
+			if err := f.set(raw); err != nil {
+				return fmt.Errorf("invalid %s: %w", f.env, err)
+			}
+		}
+		if raw, ok := overrides[f.flagName()]; ok {
+			if err := f.set(raw); err != nil {
+				return fmt.Errorf("invalid --%s: %w", f.flagName(), err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return &cfg, err
+	}
+
+	return &cfg, cfg.Validate()
+}
+
+func loadFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		err = decoder.Decode(cfg)
+		if errors.Is(err, io.EOF) {
+			// An empty file
+			return nil
+		}
+		return err
+
+	case ".toml":
+		meta, err := toml.NewDecoder(f).Decode(cfg)
+		if err != nil {
+			return err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown keys %v", undecoded)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported config file type %q", ext)
+	}
+}
+
+// Validate reports every setting that is unusable
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Nats.URLs != "", "nats.urls is required")
+	check((c.Nats.TLSCert == "") == (c.Nats.TLSKey == ""), "nats.tls_cert and nats.tls_key must be set together")
+	check(c.Nats.ConnectTimeout > 0, "nats.connect_timeout must be positive")
+	check(c.Nats.MaxReconnects >= -1, "nats.max_reconnects must be -1 or more")
+
+	for name, value := range map[string]string{
+		"streams.commands":           c.Streams.Commands,
+		"streams.events":             c.Streams.Events,
+		"streams.notifications":      c.Streams.Notifications,
+		"streams.dead_letter":        c.Streams.DeadLetter,
+		"buckets.locations":          c.Buckets.Locations,
+		"buckets.location_names":     c.Buckets.LocationNames,
+		"buckets.idempotency_keys":   c.Buckets.IdempotencyKeys,
+		"buckets.read_models":        c.Buckets.ReadModels,
+		"buckets.projections":        c.Buckets.Projections,
+		"buckets.topology":           c.Buckets.Topology,
+		"reactor.commands_consumer":  c.Reactor.CommandsConsumer,
+		"reactor.projector_consumer": c.Reactor.ProjectorConsumer,
+	} {
+		check(value != "", "%s is required", name)
+	}
+	check(c.Streams.NotificationsMaxAge > 0, "streams.notifications_max_age must be positive")
+	check(c.Streams.DeadLetterMaxAge >= 0, "streams.dead_letter_max_age must not be negative")
+	check(c.Streams.DuplicateWindow > 0, "streams.duplicate_window must be positive")
+	check(c.Streams.Replicas >= 1 && c.Streams.Replicas <= 5, "streams.replicas must be between 1 and 5")
+	check(c.Streams.Storage == "file" || c.Streams.Storage == "memory", "streams.storage must be file or memory")
+	check(c.Buckets.LocationsHistory > 0 && c.Buckets.LocationsHistory <= 64, "buckets.locations_history must be between 1 and 64")
+	check(c.Buckets.IdempotencyKeyTTL > 0, "buckets.idempotency_key_ttl must be positive")
+	check(c.Buckets.ProjectionsTTL > 0, "buckets.projections_ttl must be positive")
+
+	check(c.Timeouts.Publish > 0, "timeouts.publish must be positive")
+	check(c.Timeouts.Query > 0, "timeouts.query must be positive")
+	check(c.Timeouts.Setup > 0, "timeouts.setup must be positive")
+	check(c.Timeouts.Shutdown > 0, "timeouts.shutdown must be positive")
+
+	check(c.Server.Addr != "", "server.addr is required")
+	check(c.Server.AwaitTimeout > 0, "server.await_timeout must be positive")
+	check(c.Server.NotificationStreamTTL > 0, "server.notification_stream_ttl must be positive")
+	check(c.Server.ConsistencyTimeout > 0, "server.consistency_timeout must be positive")
+	check(c.Server.ConsistencyPollInterval > 0, "server.consistency_poll_interval must be positive")
+	check(c.Server.ListLimit > 0, "server.list_limit must be positive")
+	check(c.Server.ListMaxLimit >= c.Server.ListLimit, "server.list_max_limit must be at least server.list_limit")
+
+	consumer := c.Reactor.Consumer
+	check(consumer.BatchSize > 0, "reactor.consumer.batch_size must be positive")
+	check(consumer.MaxInFlight > 0, "reactor.consumer.max_in_flight must be positive")
+	check(consumer.AckWait >= time.Second, "reactor.consumer.ack_wait must be at least 1s")
+	check(consumer.Heartbeat >= 500*time.Millisecond, "reactor.consumer.heartbeat must be at least 500ms")
+	check(consumer.ResubscribeDelay > 0, "reactor.consumer.resubscribe_delay must be positive")
+	check(consumer.MaxDeliver > 0, "reactor.consumer.max_deliver must be positive")
+	check(consumer.RetryBackoff > 0, "reactor.consumer.retry_backoff must be positive")
+	check(consumer.RetryBackoffMax >= consumer.RetryBackoff, "reactor.consumer.retry_backoff_max must be at least retry_backoff")
+	check(consumer.RetryInPlace >= 0, "reactor.consumer.retry_in_place must not be negative")
+	check(consumer.RetryInPlace <= consumer.AckWait/2, "reactor.consumer.retry_in_place must be at most half of ack_wait")
+	check(consumer.Workers > 0, "reactor.consumer.workers must be positive")
+	check(c.Reactor.Partitions > 0, "reactor.partitions must be positive")
+	check(c.Reactor.Instances > 0, "reactor.instances must be positive")
+	check(c.Reactor.Instances <= c.Reactor.Partitions, "reactor.instances cannot exceed reactor.partitions")
+	check(c.Reactor.Instance >= 0 && c.Reactor.Instance < c.Reactor.Instances, "reactor.instance must be between 0 and reactor.instances - 1")
+	check(c.Reactor.Rebuild.FromSequence == 0 || c.Reactor.Rebuild.FromTime == "", "reactor.rebuild.from_sequence and reactor.rebuild.from_time cannot be set together")
+	if c.Reactor.Rebuild.FromTime != "" {
+		_, err := time.Parse(time.RFC3339, c.Reactor.Rebuild.FromTime)
+		check(err == nil, "reactor.rebuild.from_time must be an RFC 3339 time: %v", err)
+	}
+	check(c.Reactor.Rebuild.ProgressInterval > 0, "reactor.rebuild.progress_interval must be positive")
+	check(c.Reactor.Rebuild.Settle >= 0, "reactor.rebuild.settle must not be negative")
+
+	check(c.ReadModel.Store == ReadModelStoreKv || c.ReadModel.Sql(), "read_model.store must be kv, sqlite or postgres")
+	check(!c.ReadModel.Sql() || c.ReadModel.DSN != "", "read_model.dsn is required for a SQL read model")
+	check(c.ReadModel.MaxOpenConns > 0, "read_model.max_open_conns must be positive")
+	check(!c.ReadModel.Sql() || !c.Reactor.Rebuild.Run, "reactor.rebuild is only supported with the kv read model store")
+
+	return errors.Join(errs...)
+}
+
+// Print writes the config as YAML, with secrets redacted
+func (c Config) Print(w io.Writer) error {
+	if c.Nats.Password != "" {
+		c.Nats.Password = "********"
+	}
+	if c.Server.SessionSecret != "" {
+		c.Server.SessionSecret = "********"
+	}
+	if dsn, err := url.Parse(c.ReadModel.DSN); err == nil && dsn.User != nil {
+		if _, ok := dsn.User.Password(); ok {
+			dsn.User = url.UserPassword(dsn.User.Username(), "********")
+			c.ReadModel.DSN = dsn.String()
+		}
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	defer encoder.Close()
+	return encoder.Encode(c)
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+
+// field is a setting of the config, found by its `env` tag
+type field struct {
+	env   string
+	usage string
+	value reflect.Value
+}
+
+func (f field) flagName() string {
+	return strings.ReplaceAll(strings.ToLower(f.env), "_", "-")
+}
+
+// set parses the raw (env or flag) value into the field
+func (f field) set(raw string) error {
+	switch f.value.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		f.value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(raw, 10, f.value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(raw, 10, f.value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.value.SetUint(u)
+	default:
+		return fmt.Errorf("unsupported type %s", f.value.Type())
+	}
+	return nil
+}
+
+// visitFields calls fn for every field of the config with an `env` tag,
+// descending into nested sections
+func visitFields(cfg *Config, fn func(f field) error) error {
+	return visitStruct(reflect.ValueOf(cfg).Elem(), fn)
+}
+
+func visitStruct(v reflect.Value, fn func(f field) error) error {
+	for i := 0; i < v.NumField(); i++ {
+		structField := v.Type().Field(i)
+		value := v.Field(i)
+
+		if env, ok := structField.Tag.Lookup("env"); ok {
+			err := fn(field{env: env, usage: structField.Tag.Get("usage"), value: value})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if value.Kind() == reflect.Struct {
+			err := visitStruct(value, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+
+// flagValue records the raw value of a flag, which is only applied once the
+// lower layers have been loaded
+type flagValue struct {
+	field     field
+	overrides map[string]string
+}
+
+func (v *flagValue) String() string {
+	if v == nil || v.overrides == nil {
+		return ""
+	}
+	return fmt.Sprint(v.field.value.Interface())
+}
+
+func (v *flagValue) Set(raw string) error {
+	// Checked up front, so that mistakes are reported like any other bad flag
+	probe := field{value: reflect.New(v.field.value.Type()).Elem()}
+	if err := probe.set(raw); err != nil {
+		return err
+	}
+
+	v.overrides[v.field.flagName()] = raw
+	return nil
+}
+
+// IsBoolFlag allows boolean settings to be set with just `--flag`
+func (v *flagValue) IsBoolFlag() bool {
+	return v.field.value.Kind() == reflect.Bool
+}
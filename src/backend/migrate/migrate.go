@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"gitlab.com/greyxor/slogor"
+
+	"nats_cqrs/config"
+	"nats_cqrs/shared"
+	"nats_cqrs/topology"
+)
+
+//------------------------------------------------------------------------------
+
+// Brings the JetStream topology (streams, KV buckets & consumers) - and the
+// schema of a SQL read model - up to date with the config, before the server &
+// reactor are started
+func main() {
+	cfg, err := config.Load("migrate", os.Args[1:])
+	logLevel := slog.LevelInfo
+
+	// Setup logging
+	if cfg.Debug {
+		logLevel = slog.LevelDebug
+	}
+	logHandler := slogor.NewHandler(os.Stdout, &slogor.Options{Level: logLevel})
+	logger := slog.New(logHandler)
+	slog.SetDefault(logger)
+
+	shared.AssertOk(err, logger, "Invalid config")
+	if cfg.PrintConfig {
+		err = cfg.Print(os.Stdout)
+		shared.AssertOk(err, logger, "Failed to print config")
+		return
+	}
+
+	// Setup NATS
+	nc, err := shared.Connect("migrate", cfg.Nats, logger.With("source", "nats"))
+	shared.AssertOk(err, logger, "Failed to connect to NATS server")
+	defer nc.Close()
+
+	js, err := jetstream.New(nc)
+	shared.AssertOk(err, logger, "Failed to initialise JetStream client")
+
+	err = migrateTopology(js, cfg, logger)
+	shared.AssertOk(err, logger, "Failed to migrate topology")
+
+	if cfg.ReadModel.Sql() {
+		err = migrateSchema(cfg, logger)
+		shared.AssertOk(err, logger, "Failed to migrate read model schema")
+	}
+}
+
+func migrateTopology(js jetstream.JetStream, cfg *config.Config, logger *slog.Logger) error {
+	planCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Setup)
+	defer cancel()
+
+	changes, err := topology.Plan(planCtx, js, topology.Desired(cfg))
+	if err != nil {
+		return fmt.Errorf("failed to plan topology changes: %w", err)
+	}
+
+	if len(changes) == 0 {
+		logger.Info("Topology is up to date", "version", topology.Version)
+		return nil
+	}
+
+	for _, change := range changes {
+		if change.Destructive() {
+			logger.Warn("Pending change", "change", change.String(), "destructive", true)
+		} else {
+			logger.Info("Pending change", "change", change.String(), "destructive", false)
+		}
+	}
+
+	if cfg.Migrate.DryRun {
+		logger.Info("Dry run, not applying changes", "changes", len(changes))
+		return nil
+	}
+
+	err = topology.Apply(context.Background(), js, changes, cfg.Migrate.Force, cfg.Timeouts.Setup, logger.With("source", "migrate"))
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Migrated topology", "changes", len(changes), "version", topology.Version)
+	return nil
+}
+
+// migrateSchema applies the pending migrations of the SQL read model
+func migrateSchema(cfg *config.Config, logger *slog.Logger) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Setup)
+	defer cancel()
+
+	repo, err := shared.OpenSqlLocationsRepository(ctx, cfg.ReadModel, logger.With("source", "migrate"))
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	pending, err := repo.PendingMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		logger.Info("Read model schema is up to date", "store", cfg.ReadModel.Store)
+		return nil
+	}
+
+	for _, migration := range pending {
+		logger.Info("Pending migration", "migration", migration.String())
+	}
+
+	if cfg.Migrate.DryRun {
+		logger.Info("Dry run, not applying migrations", "migrations", len(pending))
+		return nil
+	}
+
+	applied, err := repo.Migrate(ctx)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Migrated read model schema", "store", cfg.ReadModel.Store, "migrations", len(applied))
+	return nil
+}
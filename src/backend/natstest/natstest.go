@@ -0,0 +1,79 @@
+// Package natstest runs an embedded JetStream server for tests, with the
+// topology described by the config migrated into it.
+package natstest
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/config"
+	"nats_cqrs/topology"
+)
+
+//------------------------------------------------------------------------------
+
+// RunServer starts a JetStream server on a random port, which is shut down
+// once the test is done
+func RunServer(tb testing.TB) *server.Server {
+	tb.Helper()
+
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = tb.TempDir()
+
+	s := natsserver.RunServer(&opts)
+	tb.Cleanup(s.Shutdown)
+	return s
+}
+
+// Config is the default config, pointed at the server & keeping everything in
+// memory
+func Config(s *server.Server) *config.Config {
+	cfg := config.Default()
+	cfg.Nats.URLs = s.ClientURL()
+	cfg.Streams.Storage = "memory"
+	return &cfg
+}
+
+// Connect connects to the server, closing the connection once the test is done
+func Connect(tb testing.TB, s *server.Server) (*nats.Conn, jetstream.JetStream) {
+	tb.Helper()
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		tb.Fatalf("failed to connect to NATS: %v", err)
+	}
+	tb.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		tb.Fatalf("failed to initialise JetStream client: %v", err)
+	}
+	return nc, js
+}
+
+// Migrate creates the streams, buckets & consumers described by the config
+func Migrate(tb testing.TB, js jetstream.JetStream, cfg *config.Config) {
+	tb.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Setup)
+	defer cancel()
+
+	changes, err := topology.Plan(ctx, js, topology.Desired(cfg))
+	if err != nil {
+		tb.Fatalf("failed to plan topology: %v", err)
+	}
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	err = topology.Apply(ctx, js, changes, false, cfg.Timeouts.Setup, quiet)
+	if err != nil {
+		tb.Fatalf("failed to apply topology: %v", err)
+	}
+}
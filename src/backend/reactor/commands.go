@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/shared"
+)
+
+//------------------------------------------------------------------------------
+
+// decideFunc turns a command into events, given the current state of the
+// aggregate
+type decideFunc[C shared.Command] func(aggregate *shared.LocationAggregate, command C) ([]shared.Event, error)
+
+// locationCommandHandler rehydrates the Location aggregate that the command
+// applies to, and appends the events it decides on to the event store
+func locationCommandHandler[C shared.Command](
+	notifier *Notifier,
+	store *shared.EventStore,
+	nameIndex *shared.LocationNameIndex,
+	decide decideFunc[C],
+	logger *slog.Logger,
+) shared.CommandHandler[C] {
+	return func(ctx context.Context, msg jetstream.Msg, command C) error {
+		logger := logger.With("command", command.CommandName(), "id", command.AggregateId())
+
+		aggregate, err := shared.LoadLocationAggregate(ctx, store, command.AggregateId())
+		if err != nil {
+			return fmt.Errorf("failed to load Location: %w", err)
+		}
+
+		if aggregate.Handled(command.CommandId()) {
+			logger.Info("Command has already been handled")
+			return nil
+		}
+
+		events, err := decide(aggregate, command)
+		if err != nil {
+			// A redelivered command can be rejected after reserving names on an
+			// earlier delivery, ie. if it crashed before appending its events
+			unreserveCommandNames(ctx, nameIndex, command, logger)
+			return err
+		}
+
+		if len(events) == 0 {
+			// Nothing changed, so there will be nothing for the projector to
+			// notify about
+			logger.Info("Command resulted in no events")
+			notifier.Location(command.CommandId(), msg.Headers().Get(shared.SessionIdHeader), aggregate.Location, logger)
+			return nil
+		}
+
+		err = reserveNames(ctx, nameIndex, command.CommandId(), events, logger)
+		if err != nil {
+			return err
+		}
+
+		// Guards against anything appended since the aggregate was loaded - the
+		// command is then redelivered and decided against the new state
+		recorded := aggregate.RecordedEvents(command.CommandId())
+		version, appended, err := store.Append(ctx, command, events, recorded, aggregate.Version, msg.Headers())
+		if err != nil {
+			// Names are only kept for the events that made it onto the stream
+			unreserveNames(ctx, nameIndex, command.CommandId(), events[appended:], logger)
+			return fmt.Errorf("failed to append events: %w", err)
+		}
+		logger.Info("Appended events", "count", len(events), "version", version)
+
+		releaseNames(ctx, nameIndex, aggregate.Location, events, logger)
+		return nil
+	}
+}
+
+// reserveNames claims any name that the events give the location. If one
+// can't be claimed, those already claimed are freed again.
+func reserveNames(ctx context.Context, nameIndex *shared.LocationNameIndex, commandId uuid.UUID, events []shared.Event, logger *slog.Logger) error {
+	for i, event := range events {
+		var err error
+		switch e := event.(type) {
+		case shared.LocationCreated:
+			err = nameIndex.Reserve(ctx, e.Name, e.Id, commandId)
+		case shared.LocationRenamed:
+			err = nameIndex.Reserve(ctx, e.Name, e.Id, commandId)
+		}
+		if err != nil {
+			unreserveNames(ctx, nameIndex, commandId, events[:i], logger)
+			return err
+		}
+	}
+	return nil
+}
+
+// unreserveNames frees any name that the command reserved for events that
+// were not appended after all. Names the location already held were reserved
+// by an earlier command, so are kept.
+func unreserveNames(ctx context.Context, nameIndex *shared.LocationNameIndex, commandId uuid.UUID, events []shared.Event, logger *slog.Logger) {
+	for _, event := range events {
+		switch e := event.(type) {
+		case shared.LocationCreated:
+			unreserveName(ctx, nameIndex, commandId, e.Name, logger)
+		case shared.LocationRenamed:
+			unreserveName(ctx, nameIndex, commandId, e.Name, logger)
+		}
+	}
+}
+
+// unreserveCommandNames frees any name that the command may have reserved on
+// an earlier delivery
+func unreserveCommandNames(ctx context.Context, nameIndex *shared.LocationNameIndex, command shared.Command, logger *slog.Logger) {
+	switch c := command.(type) {
+	case shared.CreateLocationCommand:
+		unreserveName(ctx, nameIndex, c.Id, c.Name, logger)
+	case shared.UpdateLocationCommand:
+		if c.Name != nil {
+			unreserveName(ctx, nameIndex, c.Id, *c.Name, logger)
+		}
+	}
+}
+
+func unreserveName(ctx context.Context, nameIndex *shared.LocationNameIndex, commandId uuid.UUID, name string, logger *slog.Logger) {
+	err := nameIndex.Unreserve(ctx, name, commandId)
+	if err != nil {
+		logger.Warn("Failed to release location name", "name", name, "err", err)
+	}
+}
+
+// releaseNames frees any name that the location no longer uses after the
+// events. Failing to do so only leaves a stale reservation, so is not fatal.
+func releaseNames(ctx context.Context, nameIndex *shared.LocationNameIndex, previous shared.Location, events []shared.Event, logger *slog.Logger) {
+	for _, event := range events {
+		switch event.(type) {
+		case shared.LocationRenamed, shared.LocationDeleted:
+			err := nameIndex.Release(ctx, previous.Name, previous.Id)
+			if err != nil {
+				logger.Warn("Failed to release location name", "name", previous.Name, "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"nats_cqrs/natstest"
+	"nats_cqrs/shared"
+)
+
+//------------------------------------------------------------------------------
+
+// If one of a command's names is taken, the names it already reserved are
+// freed again rather than held by a location that never uses them
+func TestReserveNamesFreesNamesOnPartialFailure(t *testing.T) {
+	ctx := context.Background()
+	nameIndex := newTestNameIndex(t)
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	location, other := uuid.New(), uuid.New()
+	if err := nameIndex.Reserve(ctx, "Taken", other, uuid.New()); err != nil {
+		t.Fatalf("failed to reserve name: %v", err)
+	}
+
+	events := []shared.Event{
+		shared.LocationRenamed{Id: location, Name: "Free"},
+		shared.LocationRenamed{Id: location, Name: "Taken"},
+	}
+	err := reserveNames(ctx, nameIndex, uuid.New(), events, quiet)
+	if !errors.Is(err, shared.ErrDuplicateLocationName) {
+		t.Fatalf("expected the name to be taken, got %v", err)
+	}
+
+	if err := nameIndex.Reserve(ctx, "Free", other, uuid.New()); err != nil {
+		t.Fatalf("expected the name reserved before the failure to be freed: %v", err)
+	}
+}
+
+// A command that reserved a name, then is rejected when it is redelivered,
+// frees the name - but not one that another command reserved
+func TestUnreserveCommandNamesFreesOnlyTheCommandsNames(t *testing.T) {
+	ctx := context.Background()
+	nameIndex := newTestNameIndex(t)
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	location, other := uuid.New(), uuid.New()
+	command := shared.UpdateLocationCommand{Id: uuid.New(), LocationId: location, Name: ptr("Renamed")}
+	if err := nameIndex.Reserve(ctx, "Renamed", location, command.Id); err != nil {
+		t.Fatalf("failed to reserve name: %v", err)
+	}
+
+	unreserveCommandNames(ctx, nameIndex, shared.UpdateLocationCommand{Id: uuid.New(), LocationId: location, Name: ptr("Renamed")}, quiet)
+	if err := nameIndex.Reserve(ctx, "Renamed", other, uuid.New()); !errors.Is(err, shared.ErrDuplicateLocationName) {
+		t.Fatalf("expected another command's reservation to be kept, got %v", err)
+	}
+
+	unreserveCommandNames(ctx, nameIndex, command, quiet)
+	if err := nameIndex.Reserve(ctx, "Renamed", other, uuid.New()); err != nil {
+		t.Fatalf("expected the command's reservation to be freed: %v", err)
+	}
+}
+
+//------------------------------------------------------------------------------
+
+func newTestNameIndex(tb testing.TB) *shared.LocationNameIndex {
+	tb.Helper()
+
+	s := natstest.RunServer(tb)
+	cfg := natstest.Config(s)
+	_, js := natstest.Connect(tb, s)
+	natstest.Migrate(tb, js, cfg)
+
+	kv, err := shared.OpenKv(js, cfg.Buckets.LocationNames, cfg.Timeouts.Setup)
+	if err != nil {
+		tb.Fatalf("failed to open location names KV bucket: %v", err)
+	}
+	return shared.NewLocationNameIndex(kv)
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
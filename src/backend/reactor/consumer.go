@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/config"
+	"nats_cqrs/shared"
+	"nats_cqrs/topology"
+)
+
+//------------------------------------------------------------------------------
+
+// ConsumerOptions tune how messages are pulled from a durable consumer
+type ConsumerOptions struct {
+	config.ConsumerConfig
+
+	// Partitions are the partitions of the stream that this reactor instance
+	// consumes
+	Partitions []int
+
+	// SetupTimeout bounds looking up the consumer, and PublishTimeout bounds
+	// dead-lettering a message
+	SetupTimeout   time.Duration
+	PublishTimeout time.Duration
+}
+
+func NewConsumerOptions(cfg *config.Config) ConsumerOptions {
+	return ConsumerOptions{
+		ConsumerConfig: cfg.Reactor.Consumer,
+		Partitions:     topology.InstancePartitions(cfg.Reactor.Partitions, cfg.Reactor.Instances, cfg.Reactor.Instance),
+		SetupTimeout:   cfg.Timeouts.Setup,
+		PublishTimeout: cfg.Timeouts.Publish,
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// runConsumer feeds every message on the durable consumers of the partitions
+// through handle, acking the ones that succeed, until the context is cancelled.
+// It then stops fetching, and returns once the messages already received have
+// been handled.
+//
+// Messages are pushed to the client as they arrive rather than polled for. If
+// a subscription fails (ie. missed heartbeats, or the consumer was deleted) it
+// is recreated after opts.ResubscribeDelay.
+//
+// Failed messages are retried with an exponential backoff until they have been
+// attempted opts.MaxDeliver times, and are then dead-lettered. For up to
+// opts.RetryInPlace they are retried in place, holding back the messages for
+// the same aggregate meanwhile - both the message & those held back are
+// reported in progress every third of opts.AckWait, so that none of them are
+// redelivered. After that they are redelivered with the delay instead, so that
+// one failing message doesn't hold up the rest, at the cost of the aggregate's
+// later messages overtaking it.
+//
+// Messages are handled by a pool of opts.Workers, partitioned by aggregate. The
+// stream itself is partitioned by aggregate too (see topology), so each
+// aggregate only ever belongs to the one instance consuming its partition.
+func runConsumer(
+	ctx context.Context,
+	js jetstream.JetStream,
+	streamName string,
+	consumerName string,
+	subject string,
+	handle func(ctx context.Context, msg jetstream.Msg) error,
+	notifier *Notifier,
+	opts ConsumerOptions,
+	logger *slog.Logger,
+) {
+	logger = logger.With("consumer", consumerName, "subject", subject)
+	logger.Info(
+		"Starting consumer",
+		"batch_size", opts.BatchSize,
+		"max_in_flight", opts.MaxInFlight,
+		"heartbeat", opts.Heartbeat,
+		"workers", opts.Workers,
+		"partitions", fmt.Sprint(opts.Partitions),
+	)
+
+	// Messages that were received are handled to completion, rather than being
+	// cut off when shutting down
+	handleCtx := context.WithoutCancel(ctx)
+
+	handleMsg := func(msg jetstream.Msg, inProgress func()) bool {
+		meta, _ := msg.Metadata()
+		logger := logger.With("seq", meta.Sequence.Stream, "subject", msg.Subject())
+
+		// Retried in place at first rather than redelivered, which would let
+		// the aggregate's later messages overtake it
+		started := time.Now()
+		for attempt := meta.NumDelivered; ; attempt++ {
+			err := handle(handleCtx, msg)
+			if isUnprocessableError(err) {
+				// Redelivering will never help, so set it aside straight away
+				logger.Warn("Cannot handle message", "err", err)
+				deadLetter(handleCtx, js, notifier, msg, meta, attempt, err, opts.MaxDeliver, opts.PublishTimeout, logger)
+				return true
+			}
+			if isPermanentError(err) {
+				// Redelivering will never help, so stop it from being retried
+				logger.Warn("Command was rejected", "err", err)
+				_ = msg.Term()
+				notifier.Failure(msg, err, logger)
+				return true
+			}
+			if err != nil && attempt >= uint64(opts.MaxDeliver) {
+				logger.Error("Failed to handle message, giving up", "err", err, "attempts", attempt)
+				deadLetter(handleCtx, js, notifier, msg, meta, attempt, err, opts.MaxDeliver, opts.PublishTimeout, logger)
+				return true
+			}
+			if err != nil && time.Since(started)+retryDelay(attempt, opts) > opts.RetryInPlace {
+				// Redelivered after the delay instead, so that the worker can
+				// get on with the rest of its messages
+				delay := retryDelay(attempt, opts)
+				logger.Error("Failed to handle message, redelivering", "err", err, "attempts", attempt, "delay", delay)
+				_ = msg.NakWithDelay(delay)
+				return true
+			}
+			if err != nil {
+				delay := retryDelay(attempt, opts)
+				logger.Error("Failed to handle message, retrying", "err", err, "attempts", attempt, "delay", delay)
+				if !awaitRetry(ctx, msg, delay, opts.inProgressInterval(), inProgress) {
+					// Shutting down, so leave it to the next instance
+					_ = msg.Nak()
+					return false
+				}
+				continue
+			}
+
+			err = msg.Ack()
+			if err != nil {
+				logger.Error("Failed to ack message", "err", err)
+			}
+			return true
+		}
+	}
+
+	pool := newWorkerPool(opts.Workers, handleMsg)
+	defer pool.Stop()
+
+	var partitions sync.WaitGroup
+	for _, partition := range opts.Partitions {
+		partitions.Add(1)
+		go func(partition int) {
+			defer partitions.Done()
+			consumePartition(ctx, js, streamName, topology.ConsumerName(consumerName, partition), pool, opts, logger)
+		}(partition)
+	}
+	partitions.Wait()
+
+	logger.Info("Consuming completed")
+}
+
+// consumePartition consumes the durable consumer of a partition, resubscribing
+// whenever it stops, until the context is cancelled
+func consumePartition(
+	ctx context.Context,
+	js jetstream.JetStream,
+	streamName string,
+	consumerName string,
+	pool *workerPool,
+	opts ConsumerOptions,
+	logger *slog.Logger,
+) {
+	for {
+		err := consume(ctx, js, streamName, consumerName, pool, opts)
+		if ctx.Err() != nil {
+			return
+		}
+
+		logger.Error("Consumer stopped, resubscribing", "partition_consumer", consumerName, "err", err, "delay", opts.ResubscribeDelay)
+		select {
+		case <-time.After(opts.ResubscribeDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// consume subscribes to the consumer, which is created beforehand by `migrate`,
+// and handles messages until the subscription fails or the context is cancelled
+func consume(
+	ctx context.Context,
+	js jetstream.JetStream,
+	streamName string,
+	consumerName string,
+	pool *workerPool,
+	opts ConsumerOptions,
+) error {
+	lookupCtx, cancel := context.WithTimeout(ctx, opts.SetupTimeout)
+	defer cancel()
+
+	consumer, err := js.Consumer(lookupCtx, streamName, consumerName)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := consumer.Messages(
+		jetstream.PullMaxMessages(opts.BatchSize),
+		// Draining waits for the pull request to expire, so it is kept short
+		// enough to shut down within the timeout
+		jetstream.PullExpiry(2*opts.Heartbeat),
+		jetstream.PullHeartbeat(opts.Heartbeat),
+		jetstream.WithMessagesErrOnMissingHeartbeat(true),
+	)
+	if err != nil {
+		return err
+	}
+	defer msgs.Stop()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Stops fetching, but still hands out what was already buffered
+			msgs.Drain()
+		case <-stopped:
+		}
+	}()
+
+	for {
+		msg, err := msgs.Next()
+		if err != nil {
+			return err
+		}
+		pool.Dispatch(msg)
+	}
+}
+
+// inProgressInterval is how often a message being retried, and those waiting
+// behind it, are reported as in progress - well within the ack wait
+func (o ConsumerOptions) inProgressInterval() time.Duration {
+	return o.AckWait / 3
+}
+
+// awaitRetry waits out the delay before retrying a message, keeping it & the
+// messages waiting behind it (through inProgress) from being redelivered
+// meanwhile. Reports false if the context is done first.
+func awaitRetry(ctx context.Context, msg jetstream.Msg, delay time.Duration, interval time.Duration, inProgress func()) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_ = msg.InProgress()
+		inProgress()
+		select {
+		case <-timer.C:
+			return true
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// isPermanentError reports whether the command broke an invariant, which is
+// an expected outcome rather than a failure
+func isPermanentError(err error) bool {
+	return errors.Is(err, shared.ErrCommandRejected)
+}
+
+// isUnprocessableError reports whether the message itself is bad, ie. it
+// cannot be decoded or nothing handles it
+func isUnprocessableError(err error) bool {
+	return errors.Is(err, shared.ErrMalformedMessage) ||
+		errors.Is(err, shared.ErrUnknownCommand) ||
+		errors.Is(err, shared.ErrNoCommandHandler) ||
+		errors.Is(err, shared.ErrUnknownEvent)
+}
+
+// retryDelay backs off exponentially with each attempt at the message
+func retryDelay(attempts uint64, opts ConsumerOptions) time.Duration {
+	delay := opts.RetryBackoff
+	for i := uint64(1); i < attempts && delay < opts.RetryBackoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, opts.RetryBackoffMax)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/config"
+	"nats_cqrs/natstest"
+	"nats_cqrs/shared"
+	"nats_cqrs/topology"
+)
+
+//------------------------------------------------------------------------------
+
+// Transient failures are retried in place, so every aggregate's commands are
+// still handled in order - across workers, partitions & instances
+func TestRunConsumerKeepsOrderPerAggregate(t *testing.T) {
+	load := newConsumerLoad(t, 4, 4, 2)
+	load.cfg.Reactor.Consumer.RetryBackoff = 10 * time.Millisecond
+
+	var (
+		mu     sync.Mutex
+		failed = map[string]bool{}
+	)
+	load.run(t, 20, 10, func(key string, index int) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// Fails every seventh command once
+		if index%7 == 3 && !failed[fmt.Sprint(key, index)] {
+			failed[fmt.Sprint(key, index)] = true
+			return fmt.Errorf("transient failure")
+		}
+		return nil
+	})
+	if len(failed) == 0 {
+		t.Fatal("expected some commands to fail")
+	}
+}
+
+// While a message is retried in place for longer than the ack wait, it & the
+// messages queued behind it are kept from being redelivered, so none of them
+// are handled twice
+func TestRunConsumerKeepsQueuedMessagesInProgress(t *testing.T) {
+	load := newConsumerLoad(t, 1, 1, 1)
+	load.cfg.Reactor.Consumer.AckWait = time.Second
+	load.cfg.Reactor.Consumer.RetryBackoff = 3 * time.Second
+	natstest.Migrate(t, load.js, load.cfg)
+
+	failed := false
+	load.run(t, 1, 200, func(key string, index int) error {
+		if index == 0 && !failed {
+			failed = true
+			return fmt.Errorf("transient failure")
+		}
+		return nil
+	})
+}
+
+// A message still failing once retrying it in place would take too long is
+// redelivered with the backoff delay instead, letting the worker get on with
+// the messages behind it
+func TestRunConsumerRedeliversAfterRetryingInPlace(t *testing.T) {
+	s := natstest.RunServer(t)
+	cfg := natstest.Config(s)
+	cfg.Reactor.Partitions = 1
+	cfg.Reactor.Consumer.Workers = 1
+	cfg.Reactor.Consumer.Heartbeat = 500 * time.Millisecond
+	cfg.Reactor.Consumer.RetryBackoff = 200 * time.Millisecond
+	cfg.Reactor.Consumer.RetryInPlace = 500 * time.Millisecond
+	_, js := natstest.Connect(t, s)
+	natstest.Migrate(t, js, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	failing, other := uuid.New().String(), uuid.New().String()
+	for _, id := range []string{failing, other} {
+		_, err := js.Publish(ctx, fmt.Sprintf("%s.%s.Test", shared.StreamSubjectCommands, id), nil)
+		if err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	// The failing message succeeds on its second delivery
+	handled := make(chan string, 2)
+	handle := func(ctx context.Context, msg jetstream.Msg) error {
+		// `commands.<partition>.<id>.<command>`
+		id := strings.Split(msg.Subject(), ".")[2]
+		meta, _ := msg.Metadata()
+		if id == failing && meta.NumDelivered < 2 {
+			return fmt.Errorf("transient failure")
+		}
+		handled <- id
+		return nil
+	}
+
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var consumer sync.WaitGroup
+	consumer.Add(1)
+	go func() {
+		defer consumer.Done()
+		runConsumer(ctx, js, cfg.Streams.Commands, cfg.Reactor.CommandsConsumer, "commands.>", handle, NewNotifier(js, cfg.Timeouts.Publish), NewConsumerOptions(cfg), quiet)
+	}()
+	defer func() {
+		cancel()
+		consumer.Wait()
+	}()
+
+	for _, expected := range []string{other, failing} {
+		select {
+		case id := <-handled:
+			if id != expected {
+				t.Fatalf("expected %s to be handled next, got %s", expected, id)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %s to be handled", expected)
+		}
+	}
+}
+
+// Redelivering a command that cannot be decoded will never help, so it is
+// dead-lettered on its first delivery rather than after every attempt
+func TestRunConsumerDeadLettersMalformedCommand(t *testing.T) {
+	s := natstest.RunServer(t)
+	cfg := natstest.Config(s)
+	cfg.Reactor.Consumer.Heartbeat = 500 * time.Millisecond
+	_, js := natstest.Connect(t, s)
+	natstest.Migrate(t, js, cfg)
+
+	bus := shared.NewCommandBus(js)
+	shared.RegisterCommand[shared.CreateLocationCommand](bus)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := js.Publish(ctx, shared.CommandSubject(uuid.New(), shared.CreateLocationCommand{}.CommandName()), []byte("{"))
+	if err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var consumer sync.WaitGroup
+	consumer.Add(1)
+	go func() {
+		defer consumer.Done()
+		runConsumer(ctx, js, cfg.Streams.Commands, cfg.Reactor.CommandsConsumer, "commands.>", bus.Dispatch, NewNotifier(js, cfg.Timeouts.Publish), NewConsumerOptions(cfg), quiet)
+	}()
+	defer func() {
+		cancel()
+		consumer.Wait()
+	}()
+
+	stream, err := js.Stream(ctx, cfg.Streams.DeadLetter)
+	if err != nil {
+		t.Fatalf("failed to look up dead-letter stream: %v", err)
+	}
+	var msg *jetstream.RawStreamMsg
+	for deadline := time.Now().Add(10 * time.Second); msg == nil; {
+		msg, err = stream.GetLastMsgForSubject(ctx, shared.StreamSubjectDeadLetter+".>")
+		if err != nil && time.Now().After(deadline) {
+			t.Fatalf("command was not dead-lettered: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if deliveries := msg.Header.Get(shared.DeadLetterDeliveriesHeader); deliveries != "1" {
+		t.Fatalf("expected it to be dead-lettered after 1 delivery, got %s", deliveries)
+	}
+}
+
+// Compares the throughput of more workers & instances, over commands that each
+// take a millisecond to handle
+func BenchmarkRunConsumer(b *testing.B) {
+	for _, bench := range []struct {
+		workers   int
+		instances int
+	}{
+		{1, 1},
+		{8, 1},
+		{8, 2},
+		{8, 4},
+	} {
+		b.Run(fmt.Sprintf("workers=%d/instances=%d", bench.workers, bench.instances), func(b *testing.B) {
+			load := newConsumerLoad(b, 8, bench.workers, bench.instances)
+			load.publish(b, 100, max(b.N/100, 1))
+
+			b.ResetTimer()
+			took := load.consume(b, func(key string, index int) error {
+				time.Sleep(time.Millisecond)
+				return nil
+			})
+			b.ReportMetric(float64(load.total)/took.Seconds(), "msgs/s")
+		})
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// consumerLoad publishes numbered commands for a number of aggregates, then
+// consumes them with several reactor instances, checking that each
+// aggregate's were handled once & in order
+type consumerLoad struct {
+	cfg *config.Config
+	js  jetstream.JetStream
+
+	mu      sync.Mutex
+	handled map[string][]int
+	count   int
+	total   int
+	done    chan struct{}
+}
+
+func newConsumerLoad(tb testing.TB, partitions int, workers int, instances int) *consumerLoad {
+	s := natstest.RunServer(tb)
+	cfg := natstest.Config(s)
+	cfg.Reactor.Partitions = partitions
+	cfg.Reactor.Instances = instances
+	cfg.Reactor.Consumer.Workers = workers
+	// Bounds how long shutting down waits for pull requests to expire
+	cfg.Reactor.Consumer.Heartbeat = 500 * time.Millisecond
+
+	_, js := natstest.Connect(tb, s)
+	natstest.Migrate(tb, js, cfg)
+
+	return &consumerLoad{cfg: cfg, js: js, handled: map[string][]int{}, done: make(chan struct{})}
+}
+
+// run publishes the commands & consumes them
+func (l *consumerLoad) run(tb testing.TB, aggregates int, perAggregate int, handle func(key string, index int) error) {
+	l.publish(tb, aggregates, perAggregate)
+	l.consume(tb, handle)
+}
+
+func (l *consumerLoad) publish(tb testing.TB, aggregates int, perAggregate int) {
+	tb.Helper()
+
+	ids := make([]uuid.UUID, aggregates)
+	for i := range ids {
+		ids[i] = uuid.New()
+	}
+
+	// Interleaved, as they would be by concurrent clients
+	futures := []jetstream.PubAckFuture{}
+	for index := 0; index < perAggregate; index++ {
+		for _, id := range ids {
+			future, err := l.js.PublishAsync(shared.CommandSubject(id, "Test"), []byte(strconv.Itoa(index)))
+			if err != nil {
+				tb.Fatalf("failed to publish: %v", err)
+			}
+			futures = append(futures, future)
+		}
+	}
+	for _, future := range futures {
+		select {
+		case <-future.Ok():
+		case err := <-future.Err():
+			tb.Fatalf("failed to publish: %v", err)
+		}
+	}
+	l.total = aggregates * perAggregate
+}
+
+// consume runs the instances until every command has been handled, then
+// checks the order they were handled in. Returns how long handling them took,
+// which doesn't include shutting down.
+func (l *consumerLoad) consume(tb testing.TB, handle func(key string, index int) error) time.Duration {
+	tb.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	notifier := NewNotifier(l.js, l.cfg.Timeouts.Publish)
+
+	var instances sync.WaitGroup
+	for instance := 0; instance < l.cfg.Reactor.Instances; instance++ {
+		opts := NewConsumerOptions(l.cfg)
+		opts.Partitions = topology.InstancePartitions(l.cfg.Reactor.Partitions, l.cfg.Reactor.Instances, instance)
+
+		instances.Add(1)
+		go func() {
+			defer instances.Done()
+			runConsumer(ctx, l.js, l.cfg.Streams.Commands, l.cfg.Reactor.CommandsConsumer, "commands.>", l.handler(handle), notifier, opts, quiet)
+		}()
+	}
+
+	started := time.Now()
+	select {
+	case <-l.done:
+	case <-time.After(time.Minute):
+		tb.Errorf("timed out with %d of %d commands handled", l.count, l.total)
+	}
+	took := time.Since(started)
+	if b, ok := tb.(*testing.B); ok {
+		b.StopTimer()
+	}
+	cancel()
+	instances.Wait()
+
+	for key, indexes := range l.handled {
+		for i, index := range indexes {
+			if index != i {
+				tb.Fatalf("aggregate %s handled out of order: %v", key, indexes)
+			}
+		}
+	}
+	return took
+}
+
+func (l *consumerLoad) handler(handle func(key string, index int) error) func(ctx context.Context, msg jetstream.Msg) error {
+	return func(ctx context.Context, msg jetstream.Msg) error {
+		index, err := strconv.Atoi(string(msg.Data()))
+		if err != nil {
+			return err
+		}
+		key := msg.Subject()
+
+		err = handle(key, index)
+		if err != nil {
+			return err
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		l.handled[key] = append(l.handled[key], index)
+		l.count++
+		if l.count == l.total {
+			close(l.done)
+		}
+		return nil
+	}
+}
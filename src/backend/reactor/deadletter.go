@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/shared"
+)
+
+//------------------------------------------------------------------------------
+
+// deadLetter sets the message aside on the dead-letter stream, along with why
+// it failed & after how many attempts, and stops it from being redelivered.
+// The command it belongs to is notified as failed, so that anyone awaiting it
+// does not just time out.
+//
+// If it cannot be set aside, it is redelivered to be dead-lettered again -
+// unless the server has already delivered it maxDeliver times, in which case
+// it is logged in full & dropped.
+func deadLetter(
+	ctx context.Context,
+	js jetstream.JetStream,
+	notifier *Notifier,
+	msg jetstream.Msg,
+	meta *jetstream.MsgMetadata,
+	attempts uint64,
+	cause error,
+	maxDeliver int,
+	timeout time.Duration,
+	logger *slog.Logger,
+) {
+	publishCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, err := js.PublishMsg(
+		publishCtx,
+		shared.DeadLetterMsg(msg, meta.Stream, meta.Consumer, meta.Sequence.Stream, attempts, cause),
+		// Guards against dead-lettering the same delivery twice
+		jetstream.WithMsgID(fmt.Sprintf("%s-%s-%d", meta.Stream, meta.Consumer, meta.Sequence.Stream)),
+	)
+	if err != nil && meta.NumDelivered < uint64(maxDeliver) {
+		logger.Error("Failed to dead-letter message, redelivering it", "err", err)
+		_ = msg.Nak()
+		return
+	}
+	if err != nil {
+		// The server would not redeliver it, so this is the last trace of it
+		logger.Error(
+			"Failed to dead-letter message on its last delivery, dropping it",
+			"err", err,
+			"cause", cause,
+			"attempts", attempts,
+			"headers", msg.Headers(),
+			"data", string(msg.Data()),
+		)
+	} else {
+		logger.Warn("Dead-lettered message", "attempts", attempts)
+	}
+
+	err = msg.Term()
+	if err != nil {
+		logger.Error("Failed to terminate message", "err", err)
+	}
+
+	notifier.Failure(msg, cause, logger)
+}
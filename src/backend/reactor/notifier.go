@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/shared"
+)
+
+//------------------------------------------------------------------------------
+
+// Notifier publishes the notifications for commands
+type Notifier struct {
+	js      jetstream.JetStream
+	timeout time.Duration
+}
+
+func NewNotifier(js jetstream.JetStream, timeout time.Duration) *Notifier {
+	return &Notifier{js: js, timeout: timeout}
+}
+
+func (n *Notifier) Send(commandId uuid.UUID, notification shared.Notification) error {
+	subject := shared.NotificationSubject(notification.SessionId, commandId)
+	bytes, err := json.Marshal(notification)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+
+	_, err = n.js.Publish(ctx, subject, bytes)
+	return err
+}
+
+func (n *Notifier) Location(commandId uuid.UUID, sessionId string, location shared.Location, logger *slog.Logger) {
+	err := n.Send(
+		commandId,
+		*shared.NewNotification().
+			WithCorrelationId(commandId).
+			WithSessionId(sessionId).
+			WithAction(shared.Action{
+				Type: shared.ActionRedirect,
+				Data: fmt.Sprintf("/locations/%s", location.Id.String()),
+			}).
+			WithData("location", location),
+	)
+	if err != nil {
+		logger.Error("Failed to send notification", "err", err)
+		return
+	}
+	logger.Info("Sent notification")
+}
+
+func (n *Notifier) LocationDeleted(commandId uuid.UUID, sessionId string, id uuid.UUID, logger *slog.Logger) {
+	err := n.Send(
+		commandId,
+		*shared.NewNotification().
+			WithCorrelationId(commandId).
+			WithSessionId(sessionId).
+			WithAction(shared.Action{
+				Type: shared.ActionRedirect,
+				Data: "/locations",
+			}).
+			WithData("id", id),
+	)
+	if err != nil {
+		logger.Error("Failed to send notification", "err", err)
+		return
+	}
+	logger.Info("Sent notification")
+}
+
+// Failure tells whoever submitted the command that the message belongs to
+// that it failed. Rejected commands can only be shown to the user, whereas
+// anything else may succeed if submitted again.
+func (n *Notifier) Failure(msg jetstream.Msg, cause error, logger *slog.Logger) {
+	commandId, ok := shared.CommandIdFromHeader(msg.Headers())
+	if !ok {
+		logger.Warn("Cannot notify failure of message without a command id")
+		return
+	}
+
+	notification := shared.NewNotification().
+		WithCorrelationId(commandId).
+		WithSessionId(msg.Headers().Get(shared.SessionIdHeader)).
+		WithFailure(cause)
+
+	if !errors.Is(cause, shared.ErrCommandRejected) {
+		notification.WithAction(shared.Action{
+			Type: shared.ActionRetry,
+			Data: commandId,
+		})
+	}
+	notification.WithAction(shared.Action{
+		Type: shared.ActionShowMessage,
+		Data: shared.FailureMessage(cause),
+	})
+
+	err := n.Send(commandId, *notification)
+	if err != nil {
+		logger.Error("Failed to send failure notification", "err", err)
+		return
+	}
+	logger.Info("Sent failure notification", "code", shared.ErrorCode(cause), "err", cause)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/shared"
+)
+
+//------------------------------------------------------------------------------
+
+// projectEvent applies events to the locations read model, recording the
+// sequence of the last event applied to each location as its Version. Once the
+// last event of a command has been projected, it is checkpointed & a
+// notification is sent for it - unless the checkpoints or notifier are nil.
+//
+// Events up to replayedUpTo may be projected twice, when a rebuilt read model
+// is switched over to. Any update to a location that a later event already
+// deleted is then skipped, rather than failing.
+func projectEvent(
+	notifier *Notifier,
+	locationsRepo shared.LocationsRepository,
+	checkpoints *shared.ProjectionCheckpoints,
+	replayedUpTo func() uint64,
+	logger *slog.Logger,
+) func(ctx context.Context, msg jetstream.Msg) error {
+	return func(ctx context.Context, msg jetstream.Msg) error {
+		recorded, err := shared.DecodeRecordedEvent(msg)
+		if err != nil {
+			return err
+		}
+
+		var (
+			event    = recorded.Event
+			logger   = logger.With("event", event.EventName(), "id", event.AggregateId())
+			location = shared.Location{}
+		)
+
+		switch e := event.(type) {
+		case shared.LocationCreated:
+			location.Apply(e)
+			location.Version = recorded.Sequence
+			logger.Info("Projecting Location", "name", location.Name)
+			err = locationsRepo.CreateLocation(ctx, location)
+
+		case shared.LocationDeleted:
+			logger.Info("Deleting Location")
+			err = locationsRepo.DeleteLocation(ctx, e.Id, recorded.Sequence)
+
+		default:
+			var existing *shared.Location
+			existing, err = locationsRepo.GetLocation(ctx, event.AggregateId())
+			if errors.Is(err, shared.ErrNotFound) && recorded.Sequence <= replayedUpTo() {
+				logger.Warn("Skipping replayed event for deleted Location")
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to retrieve Location: %w", err)
+			}
+			location = *existing
+			location.Apply(e)
+			location.Version = recorded.Sequence
+			logger.Info("Updating Location", "name", location.Name)
+			err = locationsRepo.UpdateLocation(ctx, location)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to project %s: %w", event.EventName(), err)
+		}
+
+		if !recorded.CommandCompleted {
+			return nil
+		}
+
+		// Checkpointed before notifying, so that anyone notified sees the
+		// command as projected
+		if checkpoints != nil {
+			err = checkpoints.RecordCommand(ctx, shared.ProjectedCommand{
+				CommandId:   recorded.CorrelationId,
+				AggregateId: event.AggregateId(),
+				Sequence:    recorded.Sequence,
+				ProjectedAt: time.Now(),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to checkpoint command: %w", err)
+			}
+		}
+
+		if notifier == nil {
+			return nil
+		}
+
+		sessionId := recorded.Header.Get(shared.SessionIdHeader)
+		if _, ok := event.(shared.LocationDeleted); ok {
+			notifier.LocationDeleted(recorded.CorrelationId, sessionId, event.AggregateId(), logger)
+		} else {
+			notifier.Location(recorded.CorrelationId, sessionId, location, logger)
+		}
+		return nil
+	}
+}
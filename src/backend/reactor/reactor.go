@@ -2,161 +2,200 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
-	"time"
 
-	"github.com/google/uuid"
-	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 	"gitlab.com/greyxor/slogor"
 
+	"nats_cqrs/config"
 	"nats_cqrs/shared"
+	"nats_cqrs/topology"
 )
 
 //------------------------------------------------------------------------------
 
 func main() {
-	var (
-		debug    = shared.GetEnv("DEBUG", "")
-		logLevel = slog.LevelInfo
-	)
+	cfg, err := config.Load("reactor", os.Args[1:])
+	logLevel := slog.LevelInfo
 
 	// Setup logging
-	if debug == "true" {
+	if cfg.Debug {
 		logLevel = slog.LevelDebug
 	}
 	logHandler := slogor.NewHandler(os.Stdout, &slogor.Options{Level: logLevel})
 	logger := slog.New(logHandler)
 	slog.SetDefault(logger)
 
+	shared.AssertOk(err, logger, "Invalid config")
+	if cfg.PrintConfig {
+		err = cfg.Print(os.Stdout)
+		shared.AssertOk(err, logger, "Failed to print config")
+		return
+	}
+
 	// Setup NATS
-	nc, err := nats.Connect(nats.DefaultURL, nats.UserInfo("user", "password"))
+	nc, err := shared.Connect("reactor", cfg.Nats, logger.With("source", "nats"))
 	shared.AssertOk(err, logger, "Failed to connect to NATS server")
 
 	js, err := jetstream.New(nc)
 	shared.AssertOk(err, logger, "Failed to iniitalise JetStream client")
 
-	err = shared.InitialiseStreams(js, logger)
-	shared.AssertOk(err, logger, "Failed to setup NATS streams")
+	checkCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Setup)
+	err = topology.Check(checkCtx, js, topology.Desired(cfg))
+	cancel()
+	shared.AssertOk(err, logger, "Failed to check NATS topology")
 
-	// NATS KV (for repositories)
-	kv, err := shared.InitialiseKv(js)
-	shared.AssertOk(err, logger, "Failed to create KV bucket")
+	// NATS KV (for which bucket each read model is served from)
+	readModelsKv, err := shared.OpenKv(js, cfg.Buckets.ReadModels, cfg.Timeouts.Setup)
+	shared.AssertOk(err, logger, "Failed to open read models KV bucket")
 
-	// Dependencies
-	locationsRepo := shared.NewNatsKvLocationsRepository(kv, logger.With("source", "locations-repo"))
+	// NATS KV (for projection checkpoints)
+	projectionsKv, err := shared.OpenKv(js, cfg.Buckets.Projections, cfg.Timeouts.Setup)
+	shared.AssertOk(err, logger, "Failed to open projections KV bucket")
 
-	go func() {
-		var (
-			subject = fmt.Sprintf("%s.>", shared.StreamSubjectCommands)
-			logger  = logger.With("source", "reactor", "subject", subject)
-		)
+	// NATS KV (for the location name index)
+	namesKv, err := shared.OpenKv(js, cfg.Buckets.LocationNames, cfg.Timeouts.Setup)
+	shared.AssertOk(err, logger, "Failed to open location names KV bucket")
 
-		logger.Info("Starting reactor")
+	consumerCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// Dependencies - the read model isn't cached, as the projector reads what it
+	// writes
+	var (
+		locationsRepo shared.LocationsRepository
+		// Events up to the read model pointer were replayed by a rebuild
+		replayedUpTo   = func() uint64 { return 0 }
+		watchReadModel = func(ctx context.Context) error { return nil }
+	)
+	repoCtx, cancel := context.WithTimeout(consumerCtx, cfg.Timeouts.Setup)
+	if cfg.ReadModel.Sql() {
+		sqlRepo, err := shared.OpenSqlLocationsRepository(repoCtx, cfg.ReadModel, logger.With("source", "locations-repo"))
+		shared.AssertOk(err, logger, "Failed to open locations read model")
+		defer sqlRepo.Close()
+
+		err = sqlRepo.CheckSchema(repoCtx)
+		shared.AssertOk(err, logger, "Failed to check read model schema")
+		locationsRepo = sqlRepo
+	} else {
+		switchingRepo, err := shared.NewSwitchingLocationsRepository(repoCtx, js, readModelsKv, cfg.Buckets.Locations, false, logger.With("source", "locations-repo"))
+		shared.AssertOk(err, logger, "Failed to open locations read model")
+
+		locationsRepo = switchingRepo
+		replayedUpTo = func() uint64 { return switchingRepo.Active().Sequence }
+		watchReadModel = switchingRepo.Watch
+	}
+	cancel()
+
+	eventStore := shared.NewEventStore(js, cfg.Streams.Events, logger.With("source", "event-store"))
+	nameIndex := shared.NewLocationNameIndex(namesKv)
+	notifier := NewNotifier(js, cfg.Timeouts.Publish)
+
+	commandBus := newCommandBus(js, notifier, eventStore, nameIndex, logger.With("source", "reactor"))
+
+	if cfg.Reactor.Rebuild.Run {
+		err = rebuildReadModel(consumerCtx, js, readModelsKv, notifier, cfg, logger.With("source", "rebuild"))
+		shared.AssertOk(err, logger, "Failed to rebuild read model")
+
+		drainCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
 		defer cancel()
+		err = shared.Drain(drainCtx, nc)
+		shared.AssertOk(err, logger, "Failed to drain NATS connection")
+		return
+	}
 
-		consumer, err := js.CreateOrUpdateConsumer(ctx, shared.StreamName, jetstream.ConsumerConfig{
-			Name:          "reactor",
-			Durable:       "reactor",
-			AckPolicy:     jetstream.AckExplicitPolicy,
-			FilterSubject: subject,
-			DeliverPolicy: jetstream.DeliverAllPolicy,
-		})
-		shared.AssertOk(err, logger, "Failed to create consumer")
-
-		projectToDb := func(msg jetstream.Msg) {
-			meta, _ := msg.Metadata()
-			logger := logger.With("seq", meta.Sequence.Stream)
-
-			command := shared.CreateLocationCommand{}
-			err := json.Unmarshal(msg.Data(), &command)
-			if err != nil {
-				logger.Error("Failed to decode message into CreateLocationCommand", "err", err)
-				_ = msg.Nak()
-				return
-			}
-
-			logger = logger.With("id", command.Id)
-
-			location := shared.NewLocationFromCommand(command)
-			logger.Info("Projecting Location", "name", location.Name)
-			err = locationsRepo.CreateLocation(context.Background(), location)
-			if err != nil {
-				logger.Error("Failed to store Location", "err", err)
-				_ = msg.Nak()
-				return
-			}
-
-			err = msg.Ack()
-			if err != nil {
-				logger.Error("Failed to ack message", "err", err)
-			}
-
-			err = sendNotification(
-				nc,
-				location.Id,
-				*shared.NewNotification().
-					WithAction(shared.Action{
-						Type: "redirect",
-						Data: fmt.Sprintf("/locations/%s", location.Id.String()),
-					}).
-					WithData("location", location),
-			)
-			if err != nil {
-				logger.Error("Failed to send notification", "err", err)
-				return
-			}
-			logger.Info("Sent notification")
-		}
+	consumerOpts := NewConsumerOptions(cfg)
 
-		ticker := time.NewTicker(1_000 * time.Millisecond)
-		defer ticker.Stop()
-
-		consumerCtx := context.Background()
-		defer consumerCtx.Done()
-
-	consumeLoop:
-		for {
-			batch, err := consumer.FetchNoWait(10)
-			if err != nil {
-				logger.Error("Error fetching batch", "err", err)
-				break consumeLoop
-			}
-
-			logger.Debug(fmt.Sprintf("Got %v messages", len(batch.Messages())))
-			for msg := range batch.Messages() {
-				projectToDb(msg)
-			}
-
-			select {
-			case <-ticker.C:
-			case <-consumerCtx.Done():
-				logger.Info("Consumer cancelled")
-				break consumeLoop
-			}
+	var consumers sync.WaitGroup
+	consumers.Add(3)
+
+	// The read model is switched over to once it has been rebuilt
+	go func() {
+		defer consumers.Done()
+		err := watchReadModel(consumerCtx)
+		if err != nil {
+			logger.Error("Failed to watch read model pointer", "err", err)
 		}
+	}()
 
-		logger.Info("Consuming completed")
+	// Commands are turned into events...
+	go func() {
+		defer consumers.Done()
+		runConsumer(
+			consumerCtx,
+			js,
+			cfg.Streams.Commands,
+			cfg.Reactor.CommandsConsumer,
+			fmt.Sprintf("%s.>", shared.StreamSubjectCommands),
+			commandBus.Dispatch,
+			notifier,
+			consumerOpts,
+			logger.With("source", "reactor"),
+		)
 	}()
 
-	done := make(chan os.Signal, 1)
-	signal.Notify(done, os.Interrupt, syscall.SIGTERM)
-	<-done
-}
+	// ...which are projected into the read model
+	go func() {
+		defer consumers.Done()
+		runConsumer(
+			consumerCtx,
+			js,
+			cfg.Streams.Events,
+			cfg.Reactor.ProjectorConsumer,
+			fmt.Sprintf("%s.>", shared.StreamSubjectEvents),
+			projectEvent(
+				notifier,
+				locationsRepo,
+				shared.NewProjectionCheckpoints(projectionsKv),
+				replayedUpTo,
+				logger.With("source", "projector"),
+			),
+			notifier,
+			consumerOpts,
+			logger.With("source", "projector"),
+		)
+	}()
+
+	<-consumerCtx.Done()
+	logger.Info("Shutting down", "timeout", cfg.Timeouts.Shutdown)
 
-func sendNotification(nc *nats.Conn, id uuid.UUID, notification shared.Notification) error {
-	subject := fmt.Sprintf("%s.%s", shared.StreamSubjectNotifications, id.String())
-	bytes, err := json.Marshal(notification)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+	defer cancel()
 
+	// Wait for the consumers to handle what they already received...
+	consumersDone := make(chan struct{})
+	go func() {
+		consumers.Wait()
+		close(consumersDone)
+	}()
+
+	select {
+	case <-consumersDone:
+	case <-shutdownCtx.Done():
+		logger.Error("Timed out waiting for consumers to finish")
+		os.Exit(1)
+	}
+
+	// ...and for their acks & notifications to be flushed
+	err = shared.Drain(shutdownCtx, nc)
 	if err != nil {
-		return err
+		logger.Error("Failed to drain NATS connection", "err", err)
+		os.Exit(1)
 	}
-	return nc.Publish(subject, bytes)
+
+	logger.Info("Shut down")
+}
+
+// newCommandBus dispatches every Location command to its handler
+func newCommandBus(js jetstream.JetStream, notifier *Notifier, eventStore *shared.EventStore, nameIndex *shared.LocationNameIndex, logger *slog.Logger) *shared.CommandBus {
+	commandBus := shared.NewCommandBus(js)
+	shared.HandleCommand(commandBus, locationCommandHandler(notifier, eventStore, nameIndex, (*shared.LocationAggregate).HandleCreate, logger))
+	shared.HandleCommand(commandBus, locationCommandHandler(notifier, eventStore, nameIndex, (*shared.LocationAggregate).HandleUpdate, logger))
+	shared.HandleCommand(commandBus, locationCommandHandler(notifier, eventStore, nameIndex, (*shared.LocationAggregate).HandleDelete, logger))
+	return commandBus
 }
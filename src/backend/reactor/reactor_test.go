@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/config"
+	"nats_cqrs/natstest"
+	"nats_cqrs/shared"
+)
+
+//------------------------------------------------------------------------------
+
+// Measures how long each command takes from being published to its
+// notification, once the reactor has handled it & the projector has projected
+// its event - with a number of clients each awaiting one command at a time
+func BenchmarkCommands(b *testing.B) {
+	for _, bench := range []struct {
+		workers int
+		clients int
+	}{
+		{1, 1},
+		{1, 16},
+		{4, 16},
+		{16, 64},
+	} {
+		b.Run(fmt.Sprintf("workers=%d/clients=%d", bench.workers, bench.clients), func(b *testing.B) {
+			s := natstest.RunServer(b)
+			cfg := natstest.Config(s)
+			cfg.Reactor.Consumer.Workers = bench.workers
+			// Bounds how long shutting down waits for pull requests to expire
+			cfg.Reactor.Consumer.Heartbeat = 500 * time.Millisecond
+
+			nc, js := natstest.Connect(b, s)
+			natstest.Migrate(b, js, cfg)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := runReactor(b, ctx, js, cfg)
+			defer func() {
+				cancel()
+				stopped.Wait()
+			}()
+
+			latencies := awaitCommands(b, nc, js, bench.clients)
+			b.StopTimer()
+
+			slices.Sort(latencies)
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "commands/s")
+			b.ReportMetric(percentile(latencies, 50), "p50-ms")
+			b.ReportMetric(percentile(latencies, 99), "p99-ms")
+		})
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// runReactor consumes commands & projects their events, as the reactor does,
+// until the context is cancelled
+func runReactor(tb testing.TB, ctx context.Context, js jetstream.JetStream, cfg *config.Config) *sync.WaitGroup {
+	tb.Helper()
+
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var kvs []jetstream.KeyValue
+	for _, bucket := range []string{cfg.Buckets.ReadModels, cfg.Buckets.Projections, cfg.Buckets.LocationNames} {
+		kv, err := shared.OpenKv(js, bucket, cfg.Timeouts.Setup)
+		if err != nil {
+			tb.Fatalf("failed to open %s KV bucket: %v", bucket, err)
+		}
+		kvs = append(kvs, kv)
+	}
+	readModelsKv, projectionsKv, namesKv := kvs[0], kvs[1], kvs[2]
+
+	locationsRepo, err := shared.NewSwitchingLocationsRepository(ctx, js, readModelsKv, cfg.Buckets.Locations, false, quiet)
+	if err != nil {
+		tb.Fatalf("failed to open locations read model: %v", err)
+	}
+
+	notifier := NewNotifier(js, cfg.Timeouts.Publish)
+	eventStore := shared.NewEventStore(js, cfg.Streams.Events, quiet)
+	commandBus := newCommandBus(js, notifier, eventStore, shared.NewLocationNameIndex(namesKv), quiet)
+	opts := NewConsumerOptions(cfg)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		runConsumer(ctx, js, cfg.Streams.Commands, cfg.Reactor.CommandsConsumer, "commands.>", commandBus.Dispatch, notifier, opts, quiet)
+	}()
+	go func() {
+		defer wg.Done()
+		project := projectEvent(notifier, locationsRepo, shared.NewProjectionCheckpoints(projectionsKv), func() uint64 { return 0 }, quiet)
+		runConsumer(ctx, js, cfg.Streams.Events, cfg.Reactor.ProjectorConsumer, "events.>", project, notifier, opts, quiet)
+	}()
+	return &wg
+}
+
+// awaitCommands creates b.N locations from a number of clients, each publishing
+// a command & awaiting its notification before the next. Returns the latency
+// of each command in milliseconds.
+func awaitCommands(b *testing.B, nc *nats.Conn, js jetstream.JetStream, clients int) []float64 {
+	b.Helper()
+
+	bus := shared.NewCommandBus(js)
+	shared.RegisterCommand[shared.CreateLocationCommand](bus)
+
+	var (
+		mu      sync.Mutex
+		waiting = map[uuid.UUID]chan struct{}{}
+	)
+	sub, err := nc.Subscribe(shared.StreamSubjectNotifications+".>", func(msg *nats.Msg) {
+		notification := shared.Notification{}
+		if json.Unmarshal(msg.Data, &notification) != nil {
+			return
+		}
+		if notification.Failed() {
+			b.Errorf("command %s failed: %+v", notification.CorrelationId, notification.Errors)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if done, ok := waiting[notification.CorrelationId]; ok {
+			close(done)
+			delete(waiting, notification.CorrelationId)
+		}
+	})
+	if err != nil {
+		b.Fatalf("failed to subscribe to notifications: %v", err)
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+
+	commands := make(chan int)
+	latencies := make(chan float64, b.N)
+
+	var wg sync.WaitGroup
+	for client := 0; client < clients; client++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range commands {
+				command := shared.CreateLocationCommand{
+					Id:          uuid.New(),
+					Name:        fmt.Sprintf("bench-%d", i),
+					Category:    "Town",
+					Description: "Benchmark",
+					CreatedAt:   time.Now(),
+				}
+
+				done := make(chan struct{})
+				mu.Lock()
+				waiting[command.Id] = done
+				mu.Unlock()
+
+				started := time.Now()
+				_, err := bus.Publish(context.Background(), command, nil)
+				if err != nil {
+					b.Errorf("failed to publish command: %v", err)
+					return
+				}
+
+				select {
+				case <-done:
+					latencies <- float64(time.Since(started)) / float64(time.Millisecond)
+				case <-time.After(10 * time.Second):
+					b.Errorf("timed out awaiting the notification for %s", command.Id)
+					return
+				}
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		commands <- i
+	}
+	close(commands)
+	wg.Wait()
+	close(latencies)
+
+	result := make([]float64, 0, b.N)
+	for latency := range latencies {
+		result = append(result, latency)
+	}
+	return result
+}
+
+// percentile of the sorted values
+func percentile(sorted []float64, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[min(len(sorted)*p/100, len(sorted)-1)]
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/config"
+	"nats_cqrs/shared"
+	"nats_cqrs/topology"
+)
+
+//------------------------------------------------------------------------------
+
+// rebuildReadModel replays the events stream into a fresh bucket, and switches
+// the locations read model over to it once it has caught up.
+//
+// Replaying from part way through the stream only has the later events to go
+// on, so the fresh bucket is first seeded with the active one. Anything already
+// there is kept, as events are only projected over earlier versions - so a
+// partial rebuild fills in what the active bucket missed, while re-deriving
+// every location takes a full one.
+//
+// The live projector carries on projecting into the old bucket meanwhile, and
+// moves over to the new one as soon as it notices the switch. Until then, the
+// rebuild keeps replaying anything the live projector received, so that
+// nothing it projected into the old bucket is missing from the new one.
+func rebuildReadModel(
+	ctx context.Context,
+	js jetstream.JetStream,
+	readModels jetstream.KeyValue,
+	notifier *Notifier,
+	cfg *config.Config,
+	logger *slog.Logger,
+) error {
+	// A SQL read model is a single database, so there is no bucket to rebuild
+	// into & switch over to
+	if cfg.ReadModel.Sql() {
+		return fmt.Errorf("rebuilding is only supported with the kv read model store, not %s", cfg.ReadModel.Store)
+	}
+	opts := cfg.Reactor.Rebuild
+
+	setupCtx, cancel := context.WithTimeout(ctx, cfg.Timeouts.Setup)
+	defer cancel()
+
+	active, err := shared.GetReadModelPointer(setupCtx, readModels, shared.LocationsReadModel, cfg.Buckets.Locations)
+	if err != nil {
+		return fmt.Errorf("failed to get read model pointer: %w", err)
+	}
+
+	bucket := opts.Bucket
+	if bucket == "" {
+		bucket = nextBucketVersion(active.Bucket)
+	}
+	if bucket == active.Bucket {
+		return fmt.Errorf("cannot rebuild into the active bucket '%s'", bucket)
+	}
+	logger = logger.With("bucket", bucket, "previous_bucket", active.Bucket)
+
+	kv, err := createRebuildBucket(setupCtx, js, cfg, bucket)
+	if err != nil {
+		return err
+	}
+
+	if opts.FromSequence > 0 || opts.FromTime != "" {
+		seeded, err := seedRebuildBucket(ctx, js, active.Bucket, kv)
+		if err != nil {
+			return fmt.Errorf("failed to seed bucket '%s': %w", bucket, err)
+		}
+		logger.Info("Seeded bucket from the active one", "locations", seeded)
+	}
+
+	consumer, err := js.OrderedConsumer(setupCtx, cfg.Streams.Events, rebuildConsumerConfig(opts))
+	if err != nil {
+		return fmt.Errorf("failed to create consumer: %w", err)
+	}
+
+	if !opts.Notify {
+		notifier = nil
+	}
+	// Every event is a replay, so updates to locations deleted before the
+	// tombstones were kept are skipped
+	replayedUpTo := func() uint64 { return math.MaxUint64 }
+	project := projectEvent(
+		notifier,
+		shared.NewNatsKvLocationsRepository(kv, logger.With("source", "locations-repo")),
+		// The live projector already checkpointed the commands
+		nil,
+		replayedUpTo,
+		logger,
+	)
+
+	progress := &rebuildProgress{started: time.Now()}
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	defer stopProgress()
+	go progress.report(progressCtx, opts.ProgressInterval, logger)
+
+	logger.Info("Rebuilding read model", "from_sequence", opts.FromSequence, "from_time", opts.FromTime, "notify", opts.Notify)
+
+	// Replay everything that is already on the stream...
+	err = replayEvents(ctx, consumer, project, cfg.Reactor.Consumer.BatchSize, 0, progress)
+	if err != nil {
+		return err
+	}
+
+	// ...then switch over to it...
+	_, last := progress.position()
+	pointer := shared.ReadModelPointer{Bucket: bucket, Sequence: last, SwitchedAt: time.Now()}
+
+	switchCtx, cancel := context.WithTimeout(ctx, cfg.Timeouts.Publish)
+	defer cancel()
+	err = shared.SwitchReadModel(switchCtx, readModels, shared.LocationsReadModel, pointer)
+	if err != nil {
+		return fmt.Errorf("failed to switch read model: %w", err)
+	}
+	logger.Info("Switched read model", "sequence", last)
+
+	// ...and catch up with whatever the live projector received before it
+	// noticed
+	select {
+	case <-time.After(opts.Settle):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	delivered, err := liveProjectorPosition(ctx, js, cfg)
+	if err != nil {
+		return err
+	}
+	if delivered > last {
+		err = replayEvents(ctx, consumer, project, cfg.Reactor.Consumer.BatchSize, delivered, progress)
+		if err != nil {
+			return err
+		}
+	}
+
+	stopProgress()
+	applied, last := progress.position()
+	logger.Info("Rebuilt read model", "events", applied, "last_sequence", last, "took", time.Since(progress.started))
+	return nil
+}
+
+// replayEvents projects events until it has caught up with the stream, or
+// until it has passed the given sequence (if any)
+func replayEvents(
+	ctx context.Context,
+	consumer jetstream.Consumer,
+	project func(ctx context.Context, msg jetstream.Msg) error,
+	batchSize int,
+	until uint64,
+	progress *rebuildProgress,
+) error {
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		batch, err := consumer.Fetch(batchSize, jetstream.FetchMaxWait(time.Second))
+		if err != nil {
+			return fmt.Errorf("failed to fetch events: %w", err)
+		}
+
+		received := 0
+		caughtUp := false
+		for msg := range batch.Messages() {
+			received++
+
+			meta, err := msg.Metadata()
+			if err != nil {
+				return err
+			}
+			err = project(ctx, msg)
+			if err != nil {
+				return fmt.Errorf("failed to project event %d: %w", meta.Sequence.Stream, err)
+			}
+
+			progress.record(meta.Sequence.Stream, meta.NumPending)
+			caughtUp = meta.NumPending == 0
+		}
+		if batch.Error() != nil {
+			return fmt.Errorf("failed to fetch events: %w", batch.Error())
+		}
+
+		_, last := progress.position()
+		if received == 0 || caughtUp || (until > 0 && last >= until) {
+			return nil
+		}
+	}
+}
+
+// createRebuildBucket creates the bucket to rebuild into, with the same
+// settings as the locations bucket. It must be empty, so that nothing is left
+// over from an earlier attempt.
+func createRebuildBucket(ctx context.Context, js jetstream.JetStream, cfg *config.Config, bucket string) (jetstream.KeyValue, error) {
+	var bucketCfg jetstream.KeyValueConfig
+	for _, desired := range topology.Desired(cfg).Buckets {
+		if desired.Bucket == cfg.Buckets.Locations {
+			bucketCfg = desired
+		}
+	}
+	bucketCfg.Bucket = bucket
+
+	kv, err := js.CreateKeyValue(ctx, bucketCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bucket '%s': %w", bucket, err)
+	}
+
+	status, err := kv.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if status.Values() > 0 {
+		return nil, fmt.Errorf("bucket '%s' already has %d values - delete it, or rebuild into another", bucket, status.Values())
+	}
+	return kv, nil
+}
+
+// seedRebuildBucket copies every location & tombstone of the active bucket into
+// the one being rebuilt, returning how many it copied
+func seedRebuildBucket(ctx context.Context, js jetstream.JetStream, activeBucket string, kv jetstream.KeyValue) (int, error) {
+	active, err := js.KeyValue(ctx, activeBucket)
+	if err != nil {
+		return 0, err
+	}
+	watcher, err := active.WatchAll(ctx, jetstream.IgnoreDeletes())
+	if err != nil {
+		return 0, err
+	}
+	defer watcher.Stop()
+
+	seeded := 0
+	for {
+		select {
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return seeded, fmt.Errorf("watcher stopped")
+			}
+			if entry == nil {
+				// Every current value has been received
+				return seeded, nil
+			}
+			_, err = kv.Put(ctx, entry.Key(), entry.Value())
+			if err != nil {
+				return seeded, err
+			}
+			seeded++
+
+		case <-ctx.Done():
+			return seeded, ctx.Err()
+		}
+	}
+}
+
+func rebuildConsumerConfig(opts config.RebuildConfig) jetstream.OrderedConsumerConfig {
+	consumerCfg := jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{fmt.Sprintf("%s.>", shared.StreamSubjectEvents)},
+		DeliverPolicy:  jetstream.DeliverAllPolicy,
+	}
+
+	if opts.FromSequence > 0 {
+		consumerCfg.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		consumerCfg.OptStartSeq = opts.FromSequence
+	}
+	if opts.FromTime != "" {
+		// Already validated
+		fromTime, _ := time.Parse(time.RFC3339, opts.FromTime)
+		consumerCfg.DeliverPolicy = jetstream.DeliverByStartTimePolicy
+		consumerCfg.OptStartTime = &fromTime
+	}
+	return consumerCfg
+}
+
+// liveProjectorPosition is the last event delivered to any of the live
+// projector's consumers
+func liveProjectorPosition(ctx context.Context, js jetstream.JetStream, cfg *config.Config) (uint64, error) {
+	var delivered uint64
+	for _, consumer := range topology.Desired(cfg).Consumers {
+		if consumer.Stream != cfg.Streams.Events {
+			continue
+		}
+
+		infoCtx, cancel := context.WithTimeout(ctx, cfg.Timeouts.Setup)
+		c, err := js.Consumer(infoCtx, consumer.Stream, consumer.Config.Durable)
+		cancel()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get consumer '%s': %w", consumer.Config.Durable, err)
+		}
+		delivered = max(delivered, c.CachedInfo().Delivered.Stream)
+	}
+	return delivered, nil
+}
+
+var bucketVersionPattern = regexp.MustCompile(`^(.+)_v(\d+)$`)
+
+// nextBucketVersion is the bucket name with its version bumped, ie.
+// `locations` -> `locations_v2` -> `locations_v3`
+func nextBucketVersion(bucket string) string {
+	if match := bucketVersionPattern.FindStringSubmatch(bucket); match != nil {
+		version, _ := strconv.Atoi(match[2])
+		return fmt.Sprintf("%s_v%d", match[1], version+1)
+	}
+	return fmt.Sprintf("%s_v2", bucket)
+}
+
+//------------------------------------------------------------------------------
+
+// rebuildProgress tracks how far through the events stream the rebuild is
+type rebuildProgress struct {
+	mu      sync.Mutex
+	started time.Time
+	applied int
+	last    uint64
+	pending uint64
+}
+
+func (p *rebuildProgress) record(sequence uint64, pending uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.applied++
+	p.last = sequence
+	p.pending = pending
+}
+
+// position is how many events were projected, and the last one's sequence
+func (p *rebuildProgress) position() (int, uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.applied, p.last
+}
+
+// report logs the progress every interval
+func (p *rebuildProgress) report(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		p.mu.Lock()
+		applied, last, pending := p.applied, p.last, p.pending
+		p.mu.Unlock()
+
+		logger.Info(
+			"Rebuild progress",
+			"events", applied,
+			"last_sequence", last,
+			"pending", pending,
+			"percent", fmt.Sprintf("%.1f", 100*float64(applied)/float64(max(uint64(applied)+pending, 1))),
+			"per_second", float64(applied)/time.Since(p.started).Seconds(),
+		)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+//------------------------------------------------------------------------------
+
+// workerPool handles messages concurrently while keeping them in order per
+// aggregate: every message for the same aggregate id is handled by the same
+// worker, one after another.
+//
+// handleMsg reports false if it left the message to be redelivered, ie. when
+// shutting down part way through retrying it. Everything else already queued
+// on that worker is then left to be redelivered too, so that none of it
+// overtakes the message. While it holds a message back, handleMsg calls
+// inProgress to keep the messages queued behind it from being redelivered.
+type workerPool struct {
+	queues []*workerQueue
+	wg     sync.WaitGroup
+}
+
+func newWorkerPool(workers int, handleMsg func(msg jetstream.Msg, inProgress func()) bool) *workerPool {
+	p := &workerPool{
+		queues: make([]*workerQueue, max(workers, 1)),
+	}
+
+	for i := range p.queues {
+		queue := &workerQueue{ready: make(chan struct{}, 1)}
+		p.queues[i] = queue
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+
+			handled := true
+			for {
+				msg, ok := queue.pop()
+				if !ok {
+					return
+				}
+				if !handled {
+					_ = msg.Nak()
+					continue
+				}
+				handled = handleMsg(msg, queue.inProgress)
+			}
+		}()
+	}
+	return p
+}
+
+// Dispatch queues the message on the worker for its aggregate. It never
+// blocks, so that every message received is queued where it can be kept in
+// progress, rather than sitting in the client's buffer.
+func (p *workerPool) Dispatch(msg jetstream.Msg) {
+	p.queues[aggregateHash(msg.Subject())%uint32(len(p.queues))].push(msg)
+}
+
+// Stop waits for the workers to finish the messages already queued
+func (p *workerPool) Stop() {
+	for _, queue := range p.queues {
+		queue.close()
+	}
+	p.wg.Wait()
+}
+
+//------------------------------------------------------------------------------
+
+// workerQueue holds the messages dispatched to a worker that it hasn't started
+// handling yet. It is unbounded, as the consumer's max in flight already
+// limits how many messages are delivered but not yet acked.
+type workerQueue struct {
+	mu     sync.Mutex
+	msgs   []jetstream.Msg
+	closed bool
+	ready  chan struct{}
+}
+
+func (q *workerQueue) push(msg jetstream.Msg) {
+	q.mu.Lock()
+	q.msgs = append(q.msgs, msg)
+	q.mu.Unlock()
+	q.signal()
+}
+
+// pop waits for the next message, reporting false once the queue is closed &
+// empty
+func (q *workerQueue) pop() (jetstream.Msg, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.msgs) > 0 {
+			msg := q.msgs[0]
+			q.msgs[0] = nil
+			q.msgs = q.msgs[1:]
+			q.mu.Unlock()
+			return msg, true
+		}
+		closed := q.closed
+		q.mu.Unlock()
+
+		if closed {
+			return nil, false
+		}
+		<-q.ready
+	}
+}
+
+func (q *workerQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *workerQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// inProgress resets the ack wait of every queued message
+func (q *workerQueue) inProgress() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, msg := range q.msgs {
+		_ = msg.InProgress()
+	}
+}
+
+// aggregateHash hashes the aggregate id of the message, which is the third
+// token of both `commands.<partition>.<id>.<command>` and
+// `events.<partition>.<id>`
+func aggregateHash(subject string) uint32 {
+	key := subject
+	if tokens := strings.SplitN(subject, ".", 4); len(tokens) >= 3 {
+		key = tokens[2]
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return hash.Sum32()
+}
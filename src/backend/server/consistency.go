@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/config"
+	"nats_cqrs/topology"
+)
+
+//------------------------------------------------------------------------------
+
+var ErrInvalidConsistencyToken = errors.New("invalid consistency token")
+
+// ConsistencyToken is the commands stream sequence of a command. Once the
+// read model has reached it, it reflects that command & every one before it.
+type ConsistencyToken uint64
+
+func (t ConsistencyToken) String() string {
+	return strconv.FormatUint(uint64(t), 10)
+}
+
+func ParseConsistencyToken(raw string) (ConsistencyToken, error) {
+	sequence, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil || sequence == 0 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidConsistencyToken, raw)
+	}
+	return ConsistencyToken(sequence), nil
+}
+
+//------------------------------------------------------------------------------
+
+// ConsistencyChecker tells whether the read model has caught up with a
+// consistency token, going by the durable consumers of the streams that the
+// topology declares.
+//
+// The read model has reached a command once the reactor has handled it (and
+// every command before it), and the projector has then projected every event
+// that had been appended by that point - which includes the command's own.
+type ConsistencyChecker struct {
+	js  jetstream.JetStream
+	cfg *config.Config
+	// consumers are the names of the declared durable consumers, by stream
+	consumers map[string]map[string]bool
+}
+
+func NewConsistencyChecker(js jetstream.JetStream, cfg *config.Config) *ConsistencyChecker {
+	return &ConsistencyChecker{js: js, cfg: cfg, consumers: topology.Desired(cfg).DurableConsumers()}
+}
+
+// Await polls until the read model reaches the token, reporting false if it
+// didn't within the timeout
+func (c *ConsistencyChecker) Await(ctx context.Context, token ConsistencyToken, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(c.cfg.Server.ConsistencyPollInterval)
+	defer ticker.Stop()
+
+	wait := &consistencyWait{token: token}
+	for {
+		reached, err := c.reached(ctx, wait)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return false, nil
+		}
+		if err != nil || reached {
+			return reached, err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false, nil
+		}
+	}
+}
+
+// consistencyWait is how far an Await has got
+type consistencyWait struct {
+	token           ConsistencyToken
+	commandsHandled bool
+	// eventsTarget is the last event once the reactor had handled the command,
+	// which the projector must then reach
+	eventsTarget uint64
+}
+
+func (c *ConsistencyChecker) reached(ctx context.Context, wait *consistencyWait) (bool, error) {
+	if !wait.commandsHandled {
+		handled, err := c.ackFloor(ctx, c.cfg.Streams.Commands)
+		if err != nil {
+			return false, err
+		}
+		if handled < uint64(wait.token) {
+			return false, nil
+		}
+
+		events, err := c.js.Stream(ctx, c.cfg.Streams.Events)
+		if err != nil {
+			return false, err
+		}
+		wait.commandsHandled = true
+		wait.eventsTarget = events.CachedInfo().State.LastSeq
+	}
+
+	projected, err := c.ackFloor(ctx, c.cfg.Streams.Events)
+	if err != nil {
+		return false, err
+	}
+	return projected >= wait.eventsTarget, nil
+}
+
+// ackFloor is the sequence that every declared durable consumer of the stream
+// has handled everything up to. Each partition of the stream has its own
+// durable consumer, which only sees the messages in its partition - so once it
+// has caught up, it has handled everything the stream held beforehand.
+//
+// Anything else consuming the stream (ie. a read model rebuild, or a consumer
+// left behind by an older topology) isn't the live reactor, so is ignored.
+func (c *ConsistencyChecker) ackFloor(ctx context.Context, streamName string) (uint64, error) {
+	stream, err := c.js.Stream(ctx, streamName)
+	if err != nil {
+		return 0, err
+	}
+	last := stream.CachedInfo().State.LastSeq
+
+	declared := c.consumers[streamName]
+
+	floor := uint64(math.MaxUint64)
+	found := 0
+	consumers := stream.ListConsumers(ctx)
+	for info := range consumers.Info() {
+		if !declared[info.Config.Durable] {
+			continue
+		}
+		found++
+
+		handled := info.AckFloor.Stream
+		if info.NumPending == 0 && info.NumAckPending == 0 {
+			handled = max(handled, last)
+		}
+		floor = min(floor, handled)
+	}
+	if consumers.Err() != nil {
+		return 0, consumers.Err()
+	}
+
+	if found < len(declared) || floor == math.MaxUint64 {
+		// A partition isn't being consumed yet, so not everything will be
+		// handled
+		return 0, nil
+	}
+	return floor, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/shared"
+)
+
+//------------------------------------------------------------------------------
+
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+
+// idempotencyNamespace is used to derive command ids from idempotency keys
+var idempotencyNamespace = uuid.MustParse("5b0c9a2e-3f4d-4e57-9a51-0f0e6d8b2c47")
+
+// IdempotencyRecord is what is remembered about the request that first used
+// an idempotency key
+type IdempotencyRecord struct {
+	CommandId   uuid.UUID `json:"command_id"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+// IdempotencyStore remembers which command each Idempotency-Key resulted in,
+// for as long as the bucket's TTL
+type IdempotencyStore struct {
+	kv jetstream.KeyValue
+}
+
+func NewIdempotencyStore(kv jetstream.KeyValue) *IdempotencyStore {
+	return &IdempotencyStore{kv: kv}
+}
+
+// Claim records the key for the request. If the key was already claimed, the
+// original record is returned instead - or ErrIdempotencyKeyReused, if it was
+// claimed by a different request.
+func (s *IdempotencyStore) Claim(ctx context.Context, key string, record IdempotencyRecord) (*IdempotencyRecord, error) {
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.kv.Create(ctx, idempotencyKvKey(key), bytes)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, jetstream.ErrKeyExists) {
+		return nil, err
+	}
+
+	entry, err := s.kv.Get(ctx, idempotencyKvKey(key))
+	if err != nil {
+		return nil, err
+	}
+
+	existing := &IdempotencyRecord{}
+	err = json.Unmarshal(entry.Value(), existing)
+	if err != nil {
+		return nil, err
+	}
+	if existing.Fingerprint != record.Fingerprint {
+		return nil, ErrIdempotencyKeyReused
+	}
+	return existing, nil
+}
+
+// Release forgets the key, ie. when the command it was claimed for could not
+// be published
+func (s *IdempotencyStore) Release(ctx context.Context, key string) error {
+	return s.kv.Delete(ctx, idempotencyKvKey(key))
+}
+
+// Keys are supplied by clients, so are hashed to fit the KV key charset
+func idempotencyKvKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+//------------------------------------------------------------------------------
+
+// newCommandId returns the id for the command submitted by the request. When
+// the request has an idempotency key, the id is derived from it so that a
+// retry always results in the same command.
+func newCommandId(r *http.Request) uuid.UUID {
+	if key := r.Header.Get(shared.IdempotencyKeyHeader); key != "" {
+		return uuid.NewSHA1(idempotencyNamespace, []byte(key))
+	}
+	return uuid.New()
+}
+
+// requestFingerprint identifies the request that an idempotency key was used
+// with, so that reusing a key for anything else can be refused
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method))
+	hash.Write([]byte(r.URL.Path))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/r3labs/sse/v2"
+
+	"nats_cqrs/shared"
+)
+
+//------------------------------------------------------------------------------
+
+const (
+	commandStreamPrefix = "command."
+	sessionStreamPrefix = "session."
+
+	notificationEventType       = "notification"
+	notificationFailedEventType = "notification-failed"
+)
+
+// NotificationBridge forwards notifications from NATS to SSE subscribers.
+//
+// Rather than broadcasting everything on a single stream, each notification is
+// routed to a stream for the command that triggered it and, when the command
+// was submitted with a session id, to a stream for that session. Streams are
+// created on demand - by either a subscriber or a notification, whichever
+// arrives first - and torn down once they have been idle for streamTTL.
+//
+// SSE event ids are the JetStream sequence of the notification, so a client
+// that reconnects with `Last-Event-ID` is replayed everything it missed from
+// the notifications stream.
+type NotificationBridge struct {
+	js         jetstream.JetStream
+	streamName string
+	sseServer  *sse.Server
+	streamTTL  time.Duration
+	sessions   *Sessions
+	logger     *slog.Logger
+
+	mu      sync.Mutex
+	streams map[string]*bridgeStream
+}
+
+type bridgeStream struct {
+	subscribers int
+	expiry      *time.Timer
+
+	// gate is held while publishing to the stream, and while a new subscriber
+	// is registered, so that no notification can fall between its replay & the
+	// notifications it is then sent
+	gate sync.Mutex
+	// replays is the number of subscribers reading their replay from JetStream,
+	// which happens outside the gate. Meanwhile, notifications published to
+	// the stream are also kept in missed, for them to pick up.
+	replays int
+	missed  []*sse.Event
+}
+
+func NewNotificationBridge(js jetstream.JetStream, streamName string, streamTTL time.Duration, sessions *Sessions, logger *slog.Logger) *NotificationBridge {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	b := &NotificationBridge{
+		js:         js,
+		streamName: streamName,
+		streamTTL:  streamTTL,
+		sessions:   sessions,
+		logger:     logger,
+		streams:    map[string]*bridgeStream{},
+	}
+
+	b.sseServer = sse.New()
+	// Streams are only created by the bridge, so unknown streams are rejected
+	b.sseServer.AutoStream = false
+	// History is replayed from JetStream instead, as the in-memory event log
+	// would overwrite our event ids
+	b.sseServer.AutoReplay = false
+	// It turns out, this is _really_ important...
+	b.sseServer.Headers = map[string]string{"Content-Encoding": "none"}
+	b.sseServer.OnSubscribe = b.onSubscribe
+	b.sseServer.OnUnsubscribe = b.onUnsubscribe
+
+	return b
+}
+
+// ServeHTTP subscribes the client to the stream for either a single command
+// (`?command=<id>&token=<stream token>`, with the stream token returned when
+// the command was submitted) or a session (`?session=<token>`, as issued by
+// POST /session).
+//
+// Command streams are always replayed from the start of the retained history,
+// so a client that connects after the notification was sent still receives
+// it. Session streams are only replayed when resuming from `Last-Event-ID`.
+func (b *NotificationBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		query     = r.URL.Query()
+		commandId = query.Get("command")
+		token     = query.Get("token")
+		session   = query.Get("session")
+		streamId  string
+		replay    = false
+		subject   string
+	)
+
+	lastEventId, err := parseLastEventId(r)
+	if err != nil {
+		http.Error(w, "Last-Event-ID must be a notification sequence", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case commandId != "":
+		id, err := uuid.Parse(commandId)
+		if err != nil {
+			http.Error(w, "command must be a valid id", http.StatusBadRequest)
+			return
+		}
+		if err := b.sessions.VerifyStreamToken(id, token); err != nil {
+			http.Error(w, "token must be the command's stream token", http.StatusUnauthorized)
+			return
+		}
+		streamId = commandStreamId(id)
+		replay = true
+		subject = shared.CommandNotificationsSubject(id)
+
+	case session != "":
+		sessionId, err := b.sessions.Verify(session)
+		if err != nil {
+			http.Error(w, "session must be a valid session token", http.StatusUnauthorized)
+			return
+		}
+		streamId = sessionStreamId(sessionId)
+		replay = lastEventId > 0
+		subject = shared.SessionNotificationsSubject(sessionId)
+
+	default:
+		http.Error(w, "Please specify a command or session", http.StatusBadRequest)
+		return
+	}
+
+	stream := b.ensureStream(streamId)
+
+	var events []*sse.Event
+	if replay {
+		// Read without holding the gate, so that publishing to the stream isn't
+		// held up - whatever is published meanwhile is picked up below
+		stream.gate.Lock()
+		stream.replays++
+		stream.gate.Unlock()
+
+		events, err = b.replay(r.Context(), subject, lastEventId+1)
+	}
+
+	stream.gate.Lock()
+	release := sync.OnceFunc(stream.gate.Unlock)
+	defer release()
+
+	rw := &replayResponseWriter{ResponseWriter: w, onWriteHeader: release}
+
+	if replay {
+		stream.replays--
+		events = appendMissed(events, stream.missed, lastEventId)
+		if stream.replays == 0 {
+			stream.missed = nil
+		}
+
+		if err != nil {
+			b.logger.Error("Failed to replay notifications", "stream", streamId, "err", err)
+			http.Error(w, "Failed to replay notifications", http.StatusInternalServerError)
+			return
+		}
+
+		if len(events) > 0 {
+			b.logger.Debug(
+				"Replaying notifications",
+				"stream", streamId,
+				"last_event_id", lastEventId,
+				"count", len(events),
+			)
+			rw.writeEvents(b.sseServer.Headers, events)
+		}
+	}
+
+	// The SSE server picks the stream from the `stream` query parameter. The
+	// tokens are not passed on, as the subscriber's URL is logged.
+	query.Del("session")
+	query.Del("token")
+	query.Set("stream", streamId)
+	r.URL.RawQuery = query.Encode()
+
+	// The gate is released once the SSE server has registered the subscriber
+	// and writes its response header
+	b.sseServer.ServeHTTP(rw, r)
+}
+
+// Run forwards notifications until the context is cancelled
+func (b *NotificationBridge) Run(ctx context.Context) error {
+	b.logger.Info("Starting notification bridge", "stream", b.streamName)
+
+	consumer, err := b.js.OrderedConsumer(ctx, b.streamName, jetstream.OrderedConsumerConfig{
+		DeliverPolicy: jetstream.DeliverNewPolicy,
+	})
+	if err != nil {
+		return err
+	}
+
+	msgs, err := consumer.Messages()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		b.logger.Info("Notifications bridge context cancelled - stopping notification bridge")
+		msgs.Stop()
+	}()
+
+	for {
+		msg, err := msgs.Next()
+		if errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+			return nil
+		}
+		if err != nil {
+			b.logger.Error("Failed to receive notification", "err", err)
+			continue
+		}
+
+		event, notification, err := notificationEvent(msg)
+		if err != nil {
+			b.logger.Error("Failed to decode message into Notification", "err", err)
+			continue
+		}
+
+		b.publish(commandStreamId(notification.CorrelationId), event)
+		if notification.SessionId != "" {
+			b.publish(sessionStreamId(notification.SessionId), event)
+		}
+	}
+}
+
+// Close disconnects every SSE subscriber, which would otherwise keep the HTTP
+// server from shutting down
+func (b *NotificationBridge) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.logger.Info("Closing notification bridge", "streams", len(b.streams))
+	for _, stream := range b.streams {
+		stream.expiry.Stop()
+	}
+	b.streams = map[string]*bridgeStream{}
+	b.sseServer.Close()
+}
+
+func (b *NotificationBridge) publish(streamId string, event *sse.Event) {
+	b.logger.Debug(
+		"Sending SSE event notification",
+		"stream", streamId,
+		"id", string(event.ID),
+	)
+
+	stream := b.ensureStream(streamId)
+
+	stream.gate.Lock()
+	defer stream.gate.Unlock()
+	if stream.replays > 0 {
+		stream.missed = append(stream.missed, event)
+	}
+	b.sseServer.Publish(streamId, event)
+}
+
+// replay reads all retained notifications on the subject, starting at the
+// given stream sequence
+func (b *NotificationBridge) replay(ctx context.Context, subject string, startSeq uint64) ([]*sse.Event, error) {
+	events := []*sse.Event{}
+
+	msgs, err := shared.ReadStream(ctx, b.js, b.streamName, subject, startSeq)
+	if err != nil {
+		return events, err
+	}
+
+	for _, msg := range msgs {
+		event, _, err := notificationEvent(msg)
+		if err != nil {
+			b.logger.Warn("Skipping undecodable notification", "err", err)
+			continue
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// appendMissed adds the notifications that were published while replaying
+// and come after both the replayed ones & the client's Last-Event-ID
+func appendMissed(events []*sse.Event, missed []*sse.Event, lastEventId uint64) []*sse.Event {
+	last := lastEventId
+	if len(events) > 0 {
+		last = max(last, eventSequence(events[len(events)-1]))
+	}
+
+	for _, event := range missed {
+		if seq := eventSequence(event); seq > last {
+			events = append(events, event)
+			last = seq
+		}
+	}
+	return events
+}
+
+// ensureStream creates the stream if it does not exist yet and pushes back
+// its expiry
+func (b *NotificationBridge) ensureStream(streamId string) *bridgeStream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stream, ok := b.streams[streamId]
+	if !ok {
+		b.logger.Debug("Creating stream", "stream", streamId)
+		b.sseServer.CreateStream(streamId)
+
+		stream = &bridgeStream{}
+		stream.expiry = time.AfterFunc(b.streamTTL, func() { b.expireStream(streamId) })
+		b.streams[streamId] = stream
+		return stream
+	}
+
+	if stream.subscribers == 0 {
+		stream.expiry.Reset(b.streamTTL)
+	}
+	return stream
+}
+
+func (b *NotificationBridge) expireStream(streamId string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stream, ok := b.streams[streamId]
+	if !ok || stream.subscribers > 0 {
+		return
+	}
+
+	b.logger.Debug("Removing idle stream", "stream", streamId)
+	b.sseServer.RemoveStream(streamId)
+	delete(b.streams, streamId)
+}
+
+func (b *NotificationBridge) onSubscribe(streamId string, sub *sse.Subscriber) {
+	b.logger.Info(
+		"Subscriber connected",
+		"stream", streamId,
+		"url", sub.URL,
+	)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if stream, ok := b.streams[streamId]; ok {
+		stream.subscribers++
+		stream.expiry.Stop()
+	}
+}
+
+func (b *NotificationBridge) onUnsubscribe(streamId string, sub *sse.Subscriber) {
+	b.logger.Info(
+		"Subscriber disconnected",
+		"stream", streamId,
+		"url", sub.URL,
+	)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if stream, ok := b.streams[streamId]; ok {
+		stream.subscribers--
+		if stream.subscribers <= 0 {
+			stream.subscribers = 0
+			stream.expiry.Reset(b.streamTTL)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// replayResponseWriter lets the SSE server take over a response that may
+// already have had replayed events written to it
+type replayResponseWriter struct {
+	http.ResponseWriter
+	headerWritten bool
+	onWriteHeader func()
+}
+
+func (w *replayResponseWriter) WriteHeader(statusCode int) {
+	w.onWriteHeader()
+	if w.headerWritten {
+		return
+	}
+	w.headerWritten = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *replayResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *replayResponseWriter) writeEvents(headers map[string]string, events []*sse.Event) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	for k, v := range headers {
+		w.Header().Set(k, v)
+	}
+
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+	w.headerWritten = true
+
+	for _, event := range events {
+		fmt.Fprintf(w, "id: %s\ndata: %s\nevent: %s\n\n", event.ID, event.Data, event.Event)
+	}
+	w.Flush()
+}
+
+//------------------------------------------------------------------------------
+
+func notificationEvent(msg jetstream.Msg) (*sse.Event, *shared.Notification, error) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notification := &shared.Notification{}
+	err = json.Unmarshal(msg.Data(), notification)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Failures are sent as a distinct event type, so that clients can listen
+	// for them separately
+	eventType := notificationEventType
+	if notification.Failed() {
+		eventType = notificationFailedEventType
+	}
+
+	event := &sse.Event{
+		ID:    []byte(strconv.FormatUint(meta.Sequence.Stream, 10)),
+		Event: []byte(eventType),
+		Data:  msg.Data(),
+	}
+	return event, notification, nil
+}
+
+// eventSequence is the notifications stream sequence of the event, which is
+// its id
+func eventSequence(event *sse.Event) uint64 {
+	seq, _ := strconv.ParseUint(string(event.ID), 10, 64)
+	return seq
+}
+
+func parseLastEventId(r *http.Request) (uint64, error) {
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(lastEventId, 10, 64)
+}
+
+func commandStreamId(commandId uuid.UUID) string {
+	return commandStreamPrefix + commandId.String()
+}
+
+func sessionStreamId(sessionId string) string {
+	return sessionStreamPrefix + sessionId
+}
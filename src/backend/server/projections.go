@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/config"
+	"nats_cqrs/shared"
+	"nats_cqrs/topology"
+)
+
+//------------------------------------------------------------------------------
+
+// ProjectionController reports how far behind the read model is, so that
+// clients can tell whether what they read is stale
+type ProjectionController struct {
+	js          jetstream.JetStream
+	repo        shared.LocationsRepository
+	checkpoints *shared.ProjectionCheckpoints
+	cfg         *config.Config
+	// consumers are the names of the declared durable consumers, by stream
+	consumers map[string]map[string]bool
+	logger    *slog.Logger
+}
+
+func NewProjectionController(
+	js jetstream.JetStream,
+	repo shared.LocationsRepository,
+	checkpoints *shared.ProjectionCheckpoints,
+	cfg *config.Config,
+	logger *slog.Logger,
+) *ProjectionController {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &ProjectionController{
+		js:          js,
+		repo:        repo,
+		checkpoints: checkpoints,
+		cfg:         cfg,
+		consumers:   topology.Desired(cfg).DurableConsumers(),
+		logger:      logger,
+	}
+}
+
+type ProjectionLag struct {
+	Store string `json:"store"`
+	// ReadModel is the active bucket, when the read model is kept in KV
+	ReadModel *shared.ReadModelPointer `json:"read_model,omitempty"`
+	Streams   []StreamLag              `json:"streams"`
+}
+
+type StreamLag struct {
+	Stream       string        `json:"stream"`
+	LastSequence uint64        `json:"last_sequence"`
+	Consumers    []ConsumerLag `json:"consumers"`
+}
+
+// ConsumerLag is how far a consumer is behind its stream. Everything up to
+// AckFloorSequence has been handled.
+type ConsumerLag struct {
+	Consumer          string `json:"consumer"`
+	Pending           uint64 `json:"pending"`
+	AckPending        int    `json:"ack_pending"`
+	Redelivered       int    `json:"redelivered"`
+	DeliveredSequence uint64 `json:"delivered_sequence"`
+	AckFloorSequence  uint64 `json:"ack_floor_sequence"`
+}
+
+// LagHandler reports the lag of every declared durable consumer of the
+// commands & events streams, including those of every reactor instance.
+// Anything else consuming them (ie. reading an aggregate's history, or a read
+// model rebuild) isn't the live reactor, so is left out.
+func (c ProjectionController) LagHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), c.cfg.Timeouts.Query)
+	defer cancel()
+
+	lag := ProjectionLag{Store: c.cfg.ReadModel.Store, Streams: []StreamLag{}}
+	if switchingRepo, ok := c.repo.(*shared.SwitchingLocationsRepository); ok {
+		active := switchingRepo.Active()
+		lag.ReadModel = &active
+	}
+	for _, streamName := range []string{c.cfg.Streams.Commands, c.cfg.Streams.Events} {
+		streamLag, err := c.streamLag(ctx, streamName)
+		if err != nil {
+			c.logger.Error("Failed to get stream lag", "stream", streamName, "err", err)
+			render.Status(r, http.StatusInternalServerError)
+			render.PlainText(w, r, err.Error())
+			return
+		}
+		lag.Streams = append(lag.Streams, *streamLag)
+	}
+
+	render.JSON(w, r, lag)
+}
+
+func (c ProjectionController) streamLag(ctx context.Context, streamName string) (*StreamLag, error) {
+	stream, err := c.js.Stream(ctx, streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	streamLag := &StreamLag{
+		Stream:       streamName,
+		LastSequence: stream.CachedInfo().State.LastSeq,
+		Consumers:    []ConsumerLag{},
+	}
+
+	declared := c.consumers[streamName]
+
+	consumers := stream.ListConsumers(ctx)
+	for info := range consumers.Info() {
+		if !declared[info.Config.Durable] {
+			continue
+		}
+		streamLag.Consumers = append(streamLag.Consumers, ConsumerLag{
+			Consumer:          info.Name,
+			Pending:           info.NumPending,
+			AckPending:        info.NumAckPending,
+			Redelivered:       info.NumRedelivered,
+			DeliveredSequence: info.Delivered.Stream,
+			AckFloorSequence:  info.AckFloor.Stream,
+		})
+	}
+	if consumers.Err() != nil {
+		return nil, consumers.Err()
+	}
+
+	return streamLag, nil
+}
+
+type CommandProjection struct {
+	CommandId uuid.UUID `json:"command_id"`
+	Projected bool      `json:"projected"`
+	*shared.ProjectedCommand
+}
+
+// CommandProjectedHandler reports whether the events of a command have been
+// projected yet, as a polling alternative to awaiting its notification. It is
+// a 404 until they have been.
+func (c ProjectionController) CommandProjectedHandler(w http.ResponseWriter, r *http.Request) {
+	commandId, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, "invalid command id")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.cfg.Timeouts.Query)
+	defer cancel()
+
+	projected, err := c.checkpoints.Command(ctx, commandId)
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.PlainText(w, r, err.Error())
+		return
+	}
+
+	if projected == nil {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, CommandProjection{CommandId: commandId})
+		return
+	}
+	render.JSON(w, r, CommandProjection{CommandId: commandId, Projected: true, ProjectedCommand: projected})
+}
@@ -3,14 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -18,27 +22,93 @@ import (
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
-	"github.com/r3labs/sse/v2"
 	slogchi "github.com/samber/slog-chi"
 	"gitlab.com/greyxor/slogor"
 
+	"nats_cqrs/config"
 	"nats_cqrs/shared"
+	"nats_cqrs/topology"
 )
 
 //------------------------------------------------------------------------------
 
 type LocationController struct {
-	nc     *nats.Conn
-	js     jetstream.JetStream
-	repo   shared.LocationsRepository
-	logger *slog.Logger
+	nc          *nats.Conn
+	js          jetstream.JetStream
+	bus         *shared.CommandBus
+	repo        shared.LocationsRepository
+	idempotency *IdempotencyStore
+	consistency *ConsistencyChecker
+	sessions    *Sessions
+	cfg         *config.Config
+	logger      *slog.Logger
 }
 
-func NewLocationController(nc *nats.Conn, js jetstream.JetStream, repo shared.LocationsRepository, logger *slog.Logger) *LocationController {
+func NewLocationController(
+	nc *nats.Conn,
+	js jetstream.JetStream,
+	bus *shared.CommandBus,
+	repo shared.LocationsRepository,
+	idempotency *IdempotencyStore,
+	consistency *ConsistencyChecker,
+	sessions *Sessions,
+	cfg *config.Config,
+	logger *slog.Logger,
+) *LocationController {
 	if logger == nil {
 		logger = slog.Default()
 	}
-	return &LocationController{nc: nc, js: js, repo: repo, logger: logger}
+	return &LocationController{
+		nc:          nc,
+		js:          js,
+		bus:         bus,
+		repo:        repo,
+		idempotency: idempotency,
+		consistency: consistency,
+		sessions:    sessions,
+		cfg:         cfg,
+		logger:      logger,
+	}
+}
+
+// awaitConsistency waits for the read model to reach the request's consistency
+// token, if it has one. If it can't be served (yet), it responds & reports
+// false.
+func (c LocationController) awaitConsistency(w http.ResponseWriter, r *http.Request) bool {
+	raw := r.Header.Get(shared.ConsistencyTokenHeader)
+	if raw == "" {
+		return true
+	}
+
+	token, err := ParseConsistencyToken(raw)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: err.Error()})
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.cfg.Server.ConsistencyTimeout)
+	defer cancel()
+
+	reached, err := c.consistency.Await(ctx, token, c.cfg.Server.ConsistencyTimeout)
+	if err == nil && reached {
+		// The projector has written it, but a cached read model may not have
+		// received it yet
+		reached, err = c.syncReadModel(ctx)
+	}
+	if err != nil {
+		c.logger.Error("Failed to check consistency token", "token", token, "err", err)
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrorResponse{Error: err.Error()})
+		return false
+	}
+	if !reached {
+		w.Header().Set("Retry-After", "1")
+		render.Status(r, http.StatusAccepted)
+		render.JSON(w, r, ErrorResponse{Error: "the read model has not caught up with the consistency token yet"})
+		return false
+	}
+	return true
 }
 
 func (c LocationController) GetLocationHandler(w http.ResponseWriter, r *http.Request) {
@@ -50,33 +120,156 @@ func (c LocationController) GetLocationHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	location, err := c.repo.GetLocation(context.Background(), id)
-	if err != nil {
-		render.Status(r, http.StatusInternalServerError)
-		render.PlainText(w, r, err.Error())
+	if !c.awaitConsistency(w, r) {
 		return
 	}
 
-	if location == nil {
-		render.Status(r, http.StatusNotFound)
+	// The revision before reading, so the location reflects at least that
+	c.setRevisionHeader(w, c.revision())
+
+	location, err := c.repo.GetLocation(context.Background(), id)
+	if errors.Is(err, shared.ErrNotFound) && r.Header.Get(shared.ConsistencyTokenHeader) == "" {
+		// It may just not have been projected yet
+		w.Header().Set("Retry-After", "1")
+	}
+	if err != nil {
+		c.renderRepositoryError(w, r, err)
 		return
 	}
 
+	w.Header().Set("ETag", versionETag(location.Version))
 	render.JSON(w, r, location)
 }
 
 func (c LocationController) ListLocationHandler(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	query, errs := c.parseLocationsQuery(r)
+	if errs != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: "invalid query", Fields: errs})
+		return
+	}
+
+	if !c.awaitConsistency(w, r) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeouts.Query)
 	defer cancel()
 
-	locations, err := c.repo.ListLocations(ctx)
+	page, err := c.repo.ListLocations(ctx, *query)
 	if err != nil {
-		render.Status(r, http.StatusInternalServerError)
-		render.PlainText(w, r, err.Error())
+		c.renderRepositoryError(w, r, err)
 		return
 	}
 
-	render.JSON(w, r, locations)
+	c.setRevisionHeader(w, page.Revision)
+	if page.NextCursor != nil {
+		next := r.URL.Query()
+		next.Set("cursor", page.NextCursor.String())
+		w.Header().Set(shared.NextCursorHeader, page.NextCursor.String())
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+	render.JSON(w, r, page.Locations)
+}
+
+// syncingRepository is a repository that serves queries from a copy of the
+// read model, which can lag behind writes to it
+type syncingRepository interface {
+	// Sync waits until the copy reflects every write so far
+	Sync(ctx context.Context) error
+	// Revision is the revision of the read model that the copy reflects
+	Revision() uint64
+}
+
+// syncReadModel waits for the repository to reflect every write to the read
+// model so far, if it can lag behind them
+func (c LocationController) syncReadModel(ctx context.Context) (bool, error) {
+	repo, ok := c.repo.(syncingRepository)
+	if !ok {
+		return true, nil
+	}
+
+	err := repo.Sync(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// revision is the revision of the read model that queries are served from, if
+// the repository knows it
+func (c LocationController) revision() uint64 {
+	if repo, ok := c.repo.(syncingRepository); ok {
+		return repo.Revision()
+	}
+	return 0
+}
+
+func (c LocationController) setRevisionHeader(w http.ResponseWriter, revision uint64) {
+	if revision > 0 {
+		w.Header().Set(shared.ReadModelRevisionHeader, strconv.FormatUint(revision, 10))
+	}
+}
+
+// parseLocationsQuery reads the page of locations to list from the query
+// string. Filters must be passed again along with the cursor of the next page.
+func (c LocationController) parseLocationsQuery(r *http.Request) (*shared.LocationsQuery, shared.ValidationError) {
+	var (
+		params = r.URL.Query()
+		errs   = shared.ValidationError{}
+		query  = &shared.LocationsQuery{
+			Category:   params.Get("category"),
+			Sort:       shared.SortByCreatedAt,
+			Descending: true,
+			Limit:      c.cfg.Server.ListLimit,
+		}
+	)
+
+	if sort := params.Get("sort"); sort != "" {
+		query.Descending = strings.HasPrefix(sort, "-")
+		query.Sort = shared.LocationsSort(strings.TrimPrefix(sort, "-"))
+		if !shared.IsLocationsSort(query.Sort) {
+			errs["sort"] = fmt.Sprintf("must be one of %s or %s, prefixed with - to sort descending", shared.SortByCreatedAt, shared.SortByName)
+		}
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		var err error
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > c.cfg.Server.ListMaxLimit {
+			errs["limit"] = fmt.Sprintf("must be between 1 and %d", c.cfg.Server.ListMaxLimit)
+		}
+	}
+
+	if query.Category != "" && !shared.IsLocationCategory(query.Category) {
+		errs["category"] = fmt.Sprintf("must be one of %s", strings.Join(shared.LocationCategories, ", "))
+	}
+
+	for param, bound := range map[string]**time.Time{"created_from": &query.CreatedFrom, "created_to": &query.CreatedTo} {
+		if raw := params.Get(param); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				errs[param] = "must be an RFC3339 time"
+				continue
+			}
+			*bound = &parsed
+		}
+	}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		var err error
+		query.After, err = shared.ParseLocationsCursor(cursor)
+		if err != nil {
+			errs["cursor"] = err.Error()
+		} else if query.After.Sort != query.Sort || query.After.Descending != query.Descending {
+			errs["cursor"] = "is for another sort"
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return query, nil
 }
 
 type CreateLocationPayload struct {
@@ -86,25 +279,130 @@ type CreateLocationPayload struct {
 }
 
 func (p CreateLocationPayload) ToCommand(id uuid.UUID, createdAt time.Time) (*shared.CreateLocationCommand, error) {
-	// TODO: Validation
+	var (
+		name        = strings.TrimSpace(p.Name)
+		category    = strings.TrimSpace(p.Category)
+		description = strings.TrimSpace(p.Description)
+		errs        = shared.ValidationError{}
+	)
+
+	validateLocationName(errs, name)
+	validateLocationCategory(errs, category)
+	validateLocationDescription(errs, description)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
 	command := shared.CreateLocationCommand{
 		Id:          id,
-		Name:        p.Name,
-		Category:    p.Category,
-		Description: p.Description,
+		Name:        name,
+		Category:    category,
+		Description: description,
 		CreatedAt:   createdAt,
 	}
 
 	return &command, nil
 }
 
+type UpdateLocationPayload struct {
+	Name        *string `json:"name"`
+	Category    *string `json:"category"`
+	Description *string `json:"description"`
+}
+
+func (p UpdateLocationPayload) ToCommand(id uuid.UUID, locationId uuid.UUID, updatedAt time.Time) (*shared.UpdateLocationCommand, error) {
+	var (
+		name        = trimmed(p.Name)
+		category    = trimmed(p.Category)
+		description = trimmed(p.Description)
+		errs        = shared.ValidationError{}
+	)
+
+	if name == nil && category == nil && description == nil {
+		errs["payload"] = "at least one field must be provided"
+	}
+	if name != nil {
+		validateLocationName(errs, *name)
+	}
+	if category != nil {
+		validateLocationCategory(errs, *category)
+	}
+	if description != nil {
+		validateLocationDescription(errs, *description)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	command := shared.UpdateLocationCommand{
+		Id:          id,
+		LocationId:  locationId,
+		Name:        name,
+		Category:    category,
+		Description: description,
+		UpdatedAt:   updatedAt,
+	}
+
+	return &command, nil
+}
+
+func validateLocationName(errs shared.ValidationError, name string) {
+	if name == "" {
+		errs["name"] = "is required"
+	} else if utf8.RuneCountInString(name) > shared.LocationNameMaxLength {
+		errs["name"] = fmt.Sprintf("must be at most %d characters", shared.LocationNameMaxLength)
+	}
+}
+
+func validateLocationCategory(errs shared.ValidationError, category string) {
+	if category == "" {
+		errs["category"] = "is required"
+	} else if !shared.IsLocationCategory(category) {
+		errs["category"] = fmt.Sprintf("must be one of: %s", strings.Join(shared.LocationCategories, ", "))
+	}
+}
+
+func validateLocationDescription(errs shared.ValidationError, description string) {
+	if utf8.RuneCountInString(description) > shared.LocationDescriptionMaxLength {
+		errs["description"] = fmt.Sprintf("must be at most %d characters", shared.LocationDescriptionMaxLength)
+	}
+}
+
+func trimmed(value *string) *string {
+	if value == nil {
+		return nil
+	}
+	trimmed := strings.TrimSpace(*value)
+	return &trimmed
+}
+
 type CommandAcceptedResponse struct {
 	Id           uuid.UUID            `json:"id"`
 	Notification *shared.Notification `json:"notification"`
+	// ConsistencyToken can be sent with queries to read what the command wrote
+	ConsistencyToken string `json:"consistency_token,omitempty"`
+	// StreamToken is required to subscribe to the command's notifications
+	StreamToken string `json:"stream_token"`
 }
 
 type ErrorResponse struct {
-	Error string `json:"error"`
+	Error          string            `json:"error"`
+	Fields         map[string]string `json:"fields,omitempty"`
+	CurrentVersion *uint64           `json:"current_version,omitempty"`
+}
+
+// renderPayloadError responds to a payload that could not be turned into a
+// command, including the per-field errors if it failed validation
+func renderPayloadError(w http.ResponseWriter, r *http.Request, err error) {
+	response := ErrorResponse{Error: err.Error()}
+
+	var validationErr shared.ValidationError
+	if errors.As(err, &validationErr) {
+		response = ErrorResponse{Error: "validation failed", Fields: validationErr}
+	}
+
+	render.Status(r, http.StatusUnprocessableEntity)
+	render.JSON(w, r, response)
 }
 
 func (c LocationController) parseNotificationHeaders(r *http.Request) (bool, time.Duration, bool) {
@@ -115,7 +413,7 @@ func (c LocationController) parseNotificationHeaders(r *http.Request) (bool, tim
 
 		err               error = nil
 		awaitNotification       = false
-		awaitTimeout            = time.Duration(2 * time.Second)
+		awaitTimeout            = c.cfg.Server.AwaitTimeout
 		simulateTimeout         = false
 	)
 
@@ -180,13 +478,13 @@ func (c LocationController) parseNotificationHeaders(r *http.Request) (bool, tim
 func (c LocationController) CreateLocationHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		payload = CreateLocationPayload{}
-		id      = uuid.New()
-		subject = fmt.Sprintf("%s.%s.CreateLocation", shared.StreamSubjectCommands, id)
-
-		awaitNotification, awaitTimeout, awaitDelay = c.parseNotificationHeaders(r)
+		id      = newCommandId(r)
 	)
 
-	err := json.NewDecoder(r.Body).Decode(&payload)
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &payload)
+	}
 	if err != nil {
 		c.logger.Error("Failed to decode payload", "err", err)
 		render.Status(r, http.StatusUnprocessableEntity)
@@ -196,145 +494,569 @@ func (c LocationController) CreateLocationHandler(w http.ResponseWriter, r *http
 
 	command, err := payload.ToCommand(id, time.Now())
 	if err != nil {
-		c.logger.Error("Failed to validate payload", "err", err)
+		c.logger.Warn("Failed to validate payload", "err", err)
+		renderPayloadError(w, r, err)
+		return
+	}
+
+	c.submitCommand(w, r, command, nil, body)
+}
+
+func (c LocationController) UpdateLocationHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		payload = UpdateLocationPayload{}
+		id      = newCommandId(r)
+	)
+
+	locationId, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusNotFound)
+		render.PlainText(w, r, "not found")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &payload)
+	}
+	if err != nil {
+		c.logger.Error("Failed to decode payload", "err", err)
 		render.Status(r, http.StatusUnprocessableEntity)
 		render.JSON(w, r, ErrorResponse{Error: err.Error()})
 		return
 	}
 
-	bytes, err := json.Marshal(command)
+	command, err := payload.ToCommand(id, locationId, time.Now())
 	if err != nil {
-		c.logger.Error("Failed to serialise command", "err", err)
-		render.Status(r, http.StatusInternalServerError)
-		render.PlainText(w, r, err.Error())
+		c.logger.Warn("Failed to validate payload", "err", err)
+		renderPayloadError(w, r, err)
+		return
+	}
+
+	command.ExpectedVersion, err = parseIfMatch(r)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.submitCommand(w, r, command, command.ExpectedVersion, body)
+}
+
+func (c LocationController) DeleteLocationHandler(w http.ResponseWriter, r *http.Request) {
+	locationId, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		render.Status(r, http.StatusNotFound)
+		render.PlainText(w, r, "not found")
+		return
+	}
+
+	expectedVersion, err := parseIfMatch(r)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	command := shared.DeleteLocationCommand{
+		Id:              newCommandId(r),
+		LocationId:      locationId,
+		DeletedAt:       time.Now(),
+		ExpectedVersion: expectedVersion,
+	}
+
+	c.submitCommand(w, r, command, expectedVersion, nil)
+}
+
+// checkVersion rejects the request up-front with a 409 if the read model
+// already shows the location at another version than expected. This is only
+// a shortcut - the reactor enforces the version against the event history.
+func (c LocationController) checkVersion(w http.ResponseWriter, r *http.Request, locationId uuid.UUID, expected *uint64) bool {
+	if expected == nil {
+		return true
+	}
+
+	location, err := c.repo.GetLocation(r.Context(), locationId)
+	if err != nil {
+		// Let the reactor decide
+		return true
+	}
+
+	if location.Version != *expected {
+		c.logger.Info(
+			"Rejecting command with stale version",
+			"id", locationId,
+			"expected", *expected,
+			"current", location.Version,
+		)
+		w.Header().Set("ETag", versionETag(location.Version))
+		render.Status(r, http.StatusConflict)
+		render.JSON(w, r, ErrorResponse{
+			Error:          shared.VersionConflictError{Expected: *expected, Current: location.Version}.Error(),
+			CurrentVersion: &location.Version,
+		})
+		return false
+	}
+	return true
+}
+
+// parseIfMatch reads the version a command expects the location to be at
+// from the `If-Match` header, as returned in the `ETag` of GET /location/{id}
+func parseIfMatch(r *http.Request) (*uint64, error) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return nil, nil
+	}
+
+	version, err := strconv.ParseUint(strings.Trim(ifMatch, `"`), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("If-Match must be a location version")
+	}
+	return &version, nil
+}
+
+func versionETag(version uint64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// submitCommand publishes the command and responds with its id, along with
+// its notification when the client asked to await it.
+//
+// A request with an `Idempotency-Key` that was already used is answered with
+// the original command instead, without publishing anything. That is looked up
+// before the expected version is checked, as a retried request will find the
+// location at the version its original command resulted in.
+func (c LocationController) submitCommand(w http.ResponseWriter, r *http.Request, command shared.Command, expectedVersion *uint64, body []byte) {
+	var (
+		id             = command.CommandId()
+		idempotencyKey = r.Header.Get(shared.IdempotencyKeyHeader)
+		err            error
+
+		awaitNotification, awaitTimeout, awaitDelay = c.parseNotificationHeaders(r)
+	)
+
+	// Notifications are only sent to the session the client was issued
+	var sessionId string
+	if token := r.Header.Get(shared.SessionTokenHeader); token != "" {
+		sessionId, err = c.sessions.Verify(token)
+		if err != nil {
+			render.Status(r, http.StatusUnauthorized)
+			render.JSON(w, r, ErrorResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	if idempotencyKey != "" {
+		claimCtx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeouts.Publish)
+		defer cancel()
+
+		original, err := c.idempotency.Claim(claimCtx, idempotencyKey, IdempotencyRecord{
+			CommandId:   id,
+			Fingerprint: requestFingerprint(r, body),
+		})
+		if errors.Is(err, ErrIdempotencyKeyReused) {
+			render.Status(r, http.StatusUnprocessableEntity)
+			render.JSON(w, r, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if err != nil {
+			c.logger.Error("Failed to claim idempotency key", "err", err)
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if original != nil {
+			c.replayCommand(w, r, original.CommandId, awaitNotification, awaitTimeout, awaitDelay)
+			return
+		}
+	}
+
+	if !c.checkVersion(w, r, command.AggregateId(), expectedVersion) {
+		c.releaseIdempotencyKey(idempotencyKey)
 		return
 	}
 
+	// The waiter must be subscribed before the command is published, otherwise
+	// a fast reactor can send the notification before we are listening for it
+	var waiter *notificationWaiter
+	if awaitNotification {
+		waiter, err = c.subscribeNotification(id, awaitDelay)
+		if err != nil {
+			c.logger.Error("Failed to subscribe to notifications", "err", err)
+			c.releaseIdempotencyKey(idempotencyKey)
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, ErrorResponse{Error: err.Error()})
+			return
+		}
+		defer waiter.Close()
+	}
+
 	c.logger.Info(
 		"Publishing command",
 		"id", id,
-		"command", "CreateLocation",
-		"subject", subject,
+		"command", command.CommandName(),
 	)
 
-	publishCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	publishCtx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeouts.Publish)
 	defer cancel()
 
-	ack, err := c.js.Publish(publishCtx, subject, bytes)
+	header := nats.Header{}
+	if sessionId != "" {
+		header.Set(shared.SessionIdHeader, sessionId)
+	}
+	if idempotencyKey != "" {
+		// Lets the stream drop the command if it was already published, ie.
+		// when a previous attempt timed out after all. The command id is
+		// derived from the key, rather than the raw key clients choose.
+		header.Set(jetstream.MsgIDHeader, id.String())
+	}
+
+	ack, err := c.bus.Publish(publishCtx, command, header)
 	if err != nil {
 		c.logger.Error("Failed to publish command", "err", err)
+		c.releaseIdempotencyKey(idempotencyKey)
 		render.Status(r, http.StatusInternalServerError)
 		render.JSON(w, r, ErrorResponse{Error: err.Error()})
 		return
 	}
-	c.logger.Debug("Got publish ack", "seq", ack.Sequence, "stream", ack.Stream)
-
-	response := CommandAcceptedResponse{Id: id}
+	c.logger.Debug("Got publish ack", "seq", ack.Sequence, "stream", ack.Stream, "duplicate", ack.Duplicate)
 
-	if !awaitNotification {
-		render.Status(r, http.StatusAccepted)
-		render.JSON(w, r, response)
-		return
+	token := ConsistencyToken(ack.Sequence)
+	w.Header().Set(shared.ConsistencyTokenHeader, token.String())
+	response := CommandAcceptedResponse{
+		Id:               id,
+		ConsistencyToken: token.String(),
+		StreamToken:      c.sessions.IssueStreamToken(id),
 	}
 
-	c.awaitNotification(&response, awaitTimeout, awaitDelay)
+	if waiter != nil {
+		response.Notification = waiter.Await(awaitTimeout)
+	}
 
-	render.Status(r, http.StatusAccepted)
+	render.Status(r, commandStatus(response.Notification))
 	render.JSON(w, r, response)
 }
 
-func (c *LocationController) awaitNotification(response *CommandAcceptedResponse, timeout time.Duration, simulateTimeout bool) {
-	var (
-		notificationsSubject       = fmt.Sprintf("%s.>", shared.StreamSubjectNotifications)
-		err                  error = nil
-		notificationsChan          = make(chan *nats.Msg)
-	)
-	c.logger.Info(
-		"Awaiting notification",
-		"timeout", timeout,
-		"subject", notificationsSubject,
-	)
+// replayCommand responds to a retried request with the command it originally
+// resulted in. The notification may already have been sent, so the stored
+// one is used if it exists.
+func (c LocationController) replayCommand(
+	w http.ResponseWriter,
+	r *http.Request,
+	id uuid.UUID,
+	awaitNotification bool,
+	awaitTimeout time.Duration,
+	awaitDelay bool,
+) {
+	c.logger.Info("Replaying command for idempotency key", "id", id)
+
+	response := CommandAcceptedResponse{Id: id, StreamToken: c.sessions.IssueStreamToken(id)}
 
-	if !simulateTimeout {
-		sub, err := c.nc.ChanSubscribe(notificationsSubject, notificationsChan)
+	if awaitNotification {
+		waiter, err := c.subscribeNotification(id, awaitDelay)
 		if err != nil {
 			c.logger.Error("Failed to subscribe to notifications", "err", err)
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, ErrorResponse{Error: err.Error()})
+			return
 		}
-		defer sub.Unsubscribe()
-	}
+		defer waiter.Close()
 
-	select {
-	case notificationMsg := <-notificationsChan:
-		c.logger.Debug("Got notification")
-		notification := &shared.Notification{}
-		err = json.Unmarshal(notificationMsg.Data, notification)
-		if err != nil {
-			c.logger.Error("Failed to parse notification message into Notification")
-			break
+		response.Notification = c.storedNotification(r.Context(), id)
+		if response.Notification == nil {
+			response.Notification = waiter.Await(awaitTimeout)
 		}
-		response.Notification = notification
-	case <-time.After(timeout):
-		c.logger.Error("Timed out waiting for notification", "timeout", timeout)
-		break
 	}
+
+	w.Header().Set(shared.IdempotencyReplayedHeader, "true")
+	render.Status(r, commandStatus(response.Notification))
+	render.JSON(w, r, response)
 }
 
-//------------------------------------------------------------------------------
+// commandStatus is the response status for a submitted command, given the
+// notification it was awaited for (if any). Commands that failed are mapped
+// from their first error code.
+func commandStatus(notification *shared.Notification) int {
+	if notification == nil || !notification.Failed() {
+		return http.StatusAccepted
+	}
 
-func getEnv(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if len(value) == 0 {
-		return defaultValue
+	switch notification.Errors[0].Code {
+	case shared.ErrorCodeLocationDoesNotExist:
+		return http.StatusNotFound
+	case shared.ErrorCodeLocationExists,
+		shared.ErrorCodeDuplicateLocationName,
+		shared.ErrorCodeVersionConflict:
+		return http.StatusConflict
+	case shared.ErrorCodeCommandRejected,
+		shared.ErrorCodeUnprocessableCommand:
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
 	}
-	return value
 }
 
-func main() {
-	var (
-		serveAddr = getEnv("SERVE_ADDR", ":3000")
-		debug     = getEnv("DEBUG", "")
+// repositoryStatus is the response status for an error from the read model
+func repositoryStatus(err error) int {
+	switch {
+	case errors.Is(err, shared.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, shared.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, shared.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// renderRepositoryError responds with the status for an error from the read
+// model. Only the sentinel is shown to the client, not the underlying error.
+func (c LocationController) renderRepositoryError(w http.ResponseWriter, r *http.Request, err error) {
+	status := repositoryStatus(err)
+	switch status {
+	case http.StatusNotFound:
+		render.Status(r, status)
+		render.PlainText(w, r, "not found")
+		return
+	case http.StatusServiceUnavailable:
+		w.Header().Set("Retry-After", "1")
+	}
+
+	c.logger.Error("Failed to query read model", "status", status, "err", err)
+	render.Status(r, status)
+	render.JSON(w, r, ErrorResponse{Error: http.StatusText(status)})
+}
+
+// storedNotification looks up the notification for the command on the
+// notifications stream, returning nil if it has not been sent (yet)
+func (c LocationController) storedNotification(ctx context.Context, commandId uuid.UUID) *shared.Notification {
+	stream, err := c.js.Stream(ctx, c.cfg.Streams.Notifications)
+	if err != nil {
+		c.logger.Error("Failed to look up notifications stream", "err", err)
+		return nil
+	}
+
+	msg, err := stream.GetLastMsgForSubject(ctx, shared.CommandNotificationsSubject(commandId))
+	if errors.Is(err, jetstream.ErrMsgNotFound) {
+		return nil
+	}
+	if err != nil {
+		c.logger.Error("Failed to look up notification", "id", commandId, "err", err)
+		return nil
+	}
+
+	notification := &shared.Notification{}
+	err = json.Unmarshal(msg.Data, notification)
+	if err != nil {
+		c.logger.Error("Failed to parse notification message into Notification", "err", err)
+		return nil
+	}
+	return notification
+}
+
+func (c LocationController) releaseIdempotencyKey(idempotencyKey string) {
+	if idempotencyKey == "" {
+		return
+	}
 
-		logLevel = slog.LevelInfo
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeouts.Query)
+	defer cancel()
+
+	err := c.idempotency.Release(ctx, idempotencyKey)
+	if err != nil {
+		c.logger.Error("Failed to release idempotency key", "err", err)
+	}
+}
+
+// notificationWaiter holds a subscription for the notification of a single
+// command, buffering anything that arrives before Await is called
+type notificationWaiter struct {
+	commandId         uuid.UUID
+	sub               *nats.Subscription
+	notificationsChan chan *nats.Msg
+	logger            *slog.Logger
+}
+
+// subscribeNotification registers a waiter for the notification of the given
+// command. The subscription is flushed to the server before returning, so any
+// notification published afterwards is guaranteed to be delivered to it.
+func (c *LocationController) subscribeNotification(commandId uuid.UUID, simulateTimeout bool) (*notificationWaiter, error) {
+	var (
+		notificationsSubject = shared.CommandNotificationsSubject(commandId)
+		waiter               = &notificationWaiter{
+			commandId:         commandId,
+			notificationsChan: make(chan *nats.Msg, 8),
+			logger:            c.logger.With("id", commandId, "subject", notificationsSubject),
+		}
 	)
 
+	if simulateTimeout {
+		return waiter, nil
+	}
+
+	sub, err := c.nc.ChanSubscribe(notificationsSubject, waiter.notificationsChan)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.nc.Flush()
+	if err != nil {
+		_ = sub.Unsubscribe()
+		return nil, err
+	}
+
+	waiter.sub = sub
+	return waiter, nil
+}
+
+// Await blocks until the notification for the command arrives, or returns nil
+// once the timeout has elapsed
+func (w *notificationWaiter) Await(timeout time.Duration) *shared.Notification {
+	w.logger.Info("Awaiting notification", "timeout", timeout)
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case notificationMsg := <-w.notificationsChan:
+			notification := &shared.Notification{}
+			err := json.Unmarshal(notificationMsg.Data, notification)
+			if err != nil {
+				w.logger.Error("Failed to parse notification message into Notification", "err", err)
+				continue
+			}
+
+			// Anything published on this subject for another command is not ours
+			if notification.CorrelationId != w.commandId {
+				w.logger.Debug(
+					"Ignoring notification for another command",
+					"correlation_id", notification.CorrelationId,
+				)
+				continue
+			}
+
+			w.logger.Debug("Got notification")
+			return notification
+
+		case <-deadline:
+			w.logger.Error("Timed out waiting for notification", "timeout", timeout)
+			return nil
+		}
+	}
+}
+
+func (w *notificationWaiter) Close() {
+	if w.sub == nil {
+		return
+	}
+	err := w.sub.Unsubscribe()
+	if err != nil {
+		w.logger.Error("Failed to unsubscribe", "err", err)
+	}
+}
+
+//------------------------------------------------------------------------------
+
+func main() {
+	cfg, err := config.Load("server", os.Args[1:])
+	logLevel := slog.LevelInfo
+
 	// Setup logging
-	if debug == "true" {
+	if cfg.Debug {
 		logLevel = slog.LevelDebug
 	}
 	logger := slog.New(slogor.NewHandler(os.Stdout, &slogor.Options{Level: logLevel}))
 	slog.SetDefault(logger)
 
+	shared.AssertOk(err, logger, "Invalid config")
+	if cfg.PrintConfig {
+		err = cfg.Print(os.Stdout)
+		shared.AssertOk(err, logger, "Failed to print config")
+		return
+	}
+
 	// Setup NATS
-	nc, err := nats.Connect(nats.DefaultURL, nats.UserInfo("user", "password"))
+	nc, err := shared.Connect("server", cfg.Nats, logger.With("source", "nats"))
 	shared.AssertOk(err, logger, "Failed to connect to NATS server")
 
 	js, err := jetstream.New(nc)
 	shared.AssertOk(err, logger, "Failed to initialise JetStream client")
 
-	err = shared.InitialiseStreams(js, logger)
-	shared.AssertOk(err, logger, "Failed to setup NATS streams")
+	// The server doesn't consume from the reactor's durable consumers, so
+	// doesn't need to agree with it on how many instances there are
+	checkCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Setup)
+	err = topology.Check(checkCtx, js, topology.Desired(cfg).WithoutConsumers())
+	cancel()
+	shared.AssertOk(err, logger, "Failed to check NATS topology")
 
-	// NATS KV (for repositories)
-	kv, err := shared.InitialiseKv(js)
-	shared.AssertOk(err, logger, "Failed to create KV bucket")
+	// NATS KV (for which bucket each read model is served from)
+	readModelsKv, err := shared.OpenKv(js, cfg.Buckets.ReadModels, cfg.Timeouts.Setup)
+	shared.AssertOk(err, logger, "Failed to open read models KV bucket")
+
+	idempotencyKv, err := shared.OpenKv(js, cfg.Buckets.IdempotencyKeys, cfg.Timeouts.Setup)
+	shared.AssertOk(err, logger, "Failed to open idempotency KV bucket")
+
+	projectionsKv, err := shared.OpenKv(js, cfg.Buckets.Projections, cfg.Timeouts.Setup)
+	shared.AssertOk(err, logger, "Failed to open projections KV bucket")
 
 	// SSE
-	sseServer := sse.New()
-	sseServer.AutoStream = true
-	// It turns out, this is _really_ important...
-	sseServer.Headers = map[string]string{"Content-Encoding": "none"}
-	sseServer.OnSubscribe = func(streamId string, sub *sse.Subscriber) {
-		logger.Info(
-			"Subscriber connected",
-			"stream", streamId,
-			"url", sub.URL,
-		)
+	if cfg.Server.SessionSecret == "" {
+		logger.Warn("No session secret is configured - session tokens will only be valid for this process")
 	}
-	sseServer.CreateStream(shared.StreamSubjectNotifications)
+	sessions, err := NewSessions(cfg.Server.SessionSecret)
+	shared.AssertOk(err, logger, "Failed to initialise sessions")
+
+	notificationBridge := NewNotificationBridge(js, cfg.Streams.Notifications, cfg.Server.NotificationStreamTTL, sessions, logger.With("source", "notification-bridge"))
 
 	// Dependencies
-	locationsRepo := shared.NewNatsKvLocationsRepository(kv, logger.With("source", "locations-repo"))
-	locationsController := NewLocationController(nc, js, locationsRepo, logger.With("source", "locations-controller"))
+	var (
+		locationsRepo  shared.LocationsRepository
+		watchReadModel = func(ctx context.Context) error { return nil }
+	)
+	repoCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Setup)
+	if cfg.ReadModel.Sql() {
+		sqlRepo, err := shared.OpenSqlLocationsRepository(repoCtx, cfg.ReadModel, logger.With("source", "locations-repo"))
+		shared.AssertOk(err, logger, "Failed to open locations read model")
+		defer sqlRepo.Close()
+
+		err = sqlRepo.CheckSchema(repoCtx)
+		shared.AssertOk(err, logger, "Failed to check read model schema")
+		locationsRepo = sqlRepo
+	} else {
+		switchingRepo, err := shared.NewSwitchingLocationsRepository(repoCtx, js, readModelsKv, cfg.Buckets.Locations, cfg.Server.CacheReadModel, logger.With("source", "locations-repo"))
+		shared.AssertOk(err, logger, "Failed to open locations read model")
+
+		locationsRepo = switchingRepo
+		watchReadModel = switchingRepo.Watch
+	}
+	cancel()
+
+	commandBus := shared.NewCommandBus(js)
+	shared.RegisterCommand[shared.CreateLocationCommand](commandBus)
+	shared.RegisterCommand[shared.UpdateLocationCommand](commandBus)
+	shared.RegisterCommand[shared.DeleteLocationCommand](commandBus)
+
+	idempotencyStore := NewIdempotencyStore(idempotencyKv)
+
+	locationsController := NewLocationController(
+		nc,
+		js,
+		commandBus,
+		locationsRepo,
+		idempotencyStore,
+		NewConsistencyChecker(js, cfg),
+		sessions,
+		cfg,
+		logger.With("source", "locations-controller"),
+	)
+
+	projectionController := NewProjectionController(
+		js,
+		locationsRepo,
+		shared.NewProjectionCheckpoints(projectionsKv),
+		cfg,
+		logger.With("source", "projection-controller"),
+	)
 
 	// Initialise router
 	r := chi.NewRouter()
@@ -350,74 +1072,67 @@ func main() {
 	})
 	r.Post("/location/create", locationsController.CreateLocationHandler)
 	r.Get("/location/{id}", locationsController.GetLocationHandler)
+	r.Patch("/location/{id}", locationsController.UpdateLocationHandler)
+	r.Delete("/location/{id}", locationsController.DeleteLocationHandler)
 	r.Get("/location", locationsController.ListLocationHandler)
+	r.Get("/command/{id}/projected", projectionController.CommandProjectedHandler)
+	r.Get("/admin/projection", projectionController.LagHandler)
 
-	r.HandleFunc("/notifications", sseServer.ServeHTTP)
+	r.Post("/session", sessions.IssueHandler)
+	r.HandleFunc("/notifications", notificationBridge.ServeHTTP)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// HTTP server
+	server := &http.Server{Addr: cfg.Server.Addr, Handler: r}
+	// SSE connections never go idle, so they are closed for Shutdown to finish
+	server.RegisterOnShutdown(notificationBridge.Close)
+
 	go func() {
-		logger.Info(fmt.Sprintf("Serving on %v", serveAddr))
-		err = http.ListenAndServe(serveAddr, r)
-		shared.AssertOk(err, logger, "Failed to start server")
+		logger.Info(fmt.Sprintf("Serving on %v", cfg.Server.Addr))
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			shared.AssertOk(err, logger, "Failed to start server")
+		}
 	}()
 
-	// Notifications bridge (SSE)
-	notificationsCtx := context.Background()
+	// The read model is switched over to once it has been rebuilt
 	go func() {
-		var (
-			logger            = logger.With("source", "notification-bridge")
-			subject           = fmt.Sprintf("%s.>", shared.StreamSubjectNotifications)
-			notificationsChan = make(chan *nats.Msg)
-		)
-		logger.Info("Starting notification bridge", "subject", subject)
-
-		sub, err := nc.ChanSubscribe(subject, notificationsChan)
-		shared.AssertOk(err, logger, "Failed to subscribe to notifications")
-		defer func() {
-			err := sub.Unsubscribe()
-			if err != nil {
-				logger.Error("Failed to unsubscribe", "err", err)
-			}
-			close(notificationsChan)
-		}()
-
-		for {
-			select {
-			case <-notificationsCtx.Done():
-				logger.Info("Notifications bridge context cancelled - stopping notification bridge")
-				return
-
-			case msg := <-notificationsChan:
-				notification := shared.Notification{}
-				err := json.Unmarshal(msg.Data, &notification)
-				if err != nil {
-					logger.Error("Failed to decode message into CreateLocationCommand", "err", err)
-					_ = msg.Nak()
-					continue
-				}
-
-				logger.Debug(
-					"Sending SSE event notification",
-					"stream", shared.StreamSubjectNotifications,
-					"id", notification.Id.String(),
-				)
-				if !sseServer.StreamExists(shared.StreamSubjectNotifications) {
-					logger.Error("Stream does not exist", "stream", shared.StreamSubjectNotifications)
-				}
-				sseServer.Publish(
-					shared.StreamSubjectNotifications,
-					&sse.Event{
-						ID:    []byte(notification.Id.String()),
-						Event: []byte("notification"),
-						Data:  msg.Data,
-					},
-				)
-				_ = msg.Ack()
-			}
+		err := watchReadModel(ctx)
+		if err != nil {
+			logger.Error("Failed to watch read model pointer", "err", err)
 		}
 	}()
 
-	done := make(chan os.Signal, 1)
-	signal.Notify(done, os.Interrupt, syscall.SIGTERM)
-	<-done
+	// Notifications bridge (SSE)
+	notificationsCtx, stopNotifications := context.WithCancel(context.Background())
+	defer stopNotifications()
+	go func() {
+		err := notificationBridge.Run(notificationsCtx)
+		shared.AssertOk(err, logger, "Failed to run notification bridge")
+	}()
+
+	<-ctx.Done()
+	logger.Info("Shutting down", "timeout", cfg.Timeouts.Shutdown)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+	defer cancel()
+
+	// Stop accepting requests, and wait for the pending ones - including any
+	// awaiting a notification - to finish or time out
+	stopNotifications()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.Error("Failed to shut down HTTP server", "err", err)
+		os.Exit(1)
+	}
+
+	err = shared.Drain(shutdownCtx, nc)
+	if err != nil {
+		logger.Error("Failed to drain NATS connection", "err", err)
+		os.Exit(1)
+	}
+
+	logger.Info("Shut down")
 }
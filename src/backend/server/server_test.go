@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/natstest"
+	"nats_cqrs/shared"
+	"nats_cqrs/topology"
+)
+
+//------------------------------------------------------------------------------
+
+// The reactor can notify about a command before the request publishing it gets
+// its ack, so awaiting the notification must not miss one sent that quickly
+func TestCreateLocationAwaitsInstantNotification(t *testing.T) {
+	controller := newTestController(t)
+
+	for i := 0; i < 50; i++ {
+		response := createLocation(t, controller, nil)
+		if response.Notification == nil {
+			t.Fatalf("command %d: missed its notification", i)
+		}
+		if response.Notification.CorrelationId != response.Id {
+			t.Fatalf("command %d: got the notification for %s", i, response.Notification.CorrelationId)
+		}
+	}
+}
+
+// A retried request gets the notification of the original command, which was
+// already sent by the time it is retried
+func TestCreateLocationReplaysNotificationForIdempotencyKey(t *testing.T) {
+	controller := newTestController(t)
+
+	header := http.Header{}
+	header.Set(shared.IdempotencyKeyHeader, "retried")
+
+	original := createLocation(t, controller, header)
+	retried := createLocation(t, controller, header)
+
+	if retried.Id != original.Id {
+		t.Fatalf("expected the original command %s, got %s", original.Id, retried.Id)
+	}
+	if retried.Notification == nil || retried.Notification.CorrelationId != original.Id {
+		t.Fatalf("expected the original command's notification, got %+v", retried.Notification)
+	}
+}
+
+// A command's notifications can only be subscribed to with the stream token
+// its submitter was given, not with its id alone
+func TestNotificationsRequireCommandStreamToken(t *testing.T) {
+	controller := newTestController(t)
+	response := createLocation(t, controller, nil)
+	if err := controller.sessions.VerifyStreamToken(response.Id, response.StreamToken); err != nil {
+		t.Fatalf("expected a stream token for the command: %v", err)
+	}
+
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	bridge := NewNotificationBridge(nil, "", time.Minute, controller.sessions, quiet)
+	for _, token := range []string{"", controller.sessions.IssueStreamToken(uuid.New())} {
+		w := httptest.NewRecorder()
+		bridge.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/notifications?command="+response.Id.String()+"&token="+token, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected token %q to be rejected, got %d", token, w.Code)
+		}
+	}
+}
+
+// Ephemeral consumers, ie. reading an aggregate's history, aren't reported as
+// lagging behind
+func TestLagHandlerOnlyReportsDeclaredConsumers(t *testing.T) {
+	s := natstest.RunServer(t)
+	cfg := natstest.Config(s)
+	_, js := natstest.Connect(t, s)
+	natstest.Migrate(t, js, cfg)
+
+	_, err := js.OrderedConsumer(context.Background(), cfg.Streams.Events, jetstream.OrderedConsumerConfig{})
+	if err != nil {
+		t.Fatalf("failed to create ephemeral consumer: %v", err)
+	}
+
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	controller := NewProjectionController(js, nil, nil, cfg, quiet)
+	w := httptest.NewRecorder()
+	controller.LagHandler(w, httptest.NewRequest(http.MethodGet, "/admin/projection", nil))
+
+	lag := ProjectionLag{}
+	if err := json.Unmarshal(w.Body.Bytes(), &lag); err != nil {
+		t.Fatalf("failed to decode lag %q: %v", w.Body.String(), err)
+	}
+	declared := topology.Desired(cfg).DurableConsumers()
+	for _, stream := range lag.Streams {
+		if len(stream.Consumers) != len(declared[stream.Stream]) {
+			t.Fatalf("expected only the declared consumers of %s, got %+v", stream.Stream, stream.Consumers)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// newTestController runs the controller against an embedded server, where
+// commands are answered by replyInstantly
+func newTestController(tb testing.TB) *LocationController {
+	tb.Helper()
+
+	s := natstest.RunServer(tb)
+	cfg := natstest.Config(s)
+	nc, js := natstest.Connect(tb, s)
+	natstest.Migrate(tb, js, cfg)
+
+	idempotencyKv, err := shared.OpenKv(js, cfg.Buckets.IdempotencyKeys, cfg.Timeouts.Setup)
+	if err != nil {
+		tb.Fatalf("failed to open idempotency KV bucket: %v", err)
+	}
+	sessions, err := NewSessions("test")
+	if err != nil {
+		tb.Fatalf("failed to initialise sessions: %v", err)
+	}
+
+	bus := shared.NewCommandBus(instantReactor{JetStream: js, notified: replyInstantly(tb, nc)})
+	shared.RegisterCommand[shared.CreateLocationCommand](bus)
+
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	controller := NewLocationController(
+		nc,
+		js,
+		bus,
+		nil,
+		NewIdempotencyStore(idempotencyKv),
+		NewConsistencyChecker(js, cfg),
+		sessions,
+		cfg,
+		quiet,
+	)
+	return controller
+}
+
+// instantReactor only returns from publishing a command once replyInstantly
+// has notified about it, as if the reactor was quicker than the ack
+type instantReactor struct {
+	jetstream.JetStream
+	notified <-chan struct{}
+}
+
+func (r instantReactor) PublishMsg(ctx context.Context, msg *nats.Msg, opts ...jetstream.PublishOpt) (*jetstream.PubAck, error) {
+	ack, err := r.JetStream.PublishMsg(ctx, msg, opts...)
+	if err != nil {
+		return ack, err
+	}
+
+	select {
+	case <-r.notified:
+		return ack, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// replyInstantly stands in for the reactor, notifying about every command as
+// soon as it is published. Once a notification has reached the server, it is
+// sent on the returned channel.
+func replyInstantly(tb testing.TB, nc *nats.Conn) <-chan struct{} {
+	tb.Helper()
+
+	notified := make(chan struct{}, 1)
+	sub, err := nc.Subscribe(shared.StreamSubjectCommands+".>", func(msg *nats.Msg) {
+		commandId, ok := shared.CommandIdFromHeader(msg.Header)
+		if !ok {
+			return
+		}
+		sessionId := msg.Header.Get(shared.SessionIdHeader)
+
+		bytes, err := json.Marshal(shared.NewNotification().WithCorrelationId(commandId).WithSessionId(sessionId))
+		if err != nil {
+			tb.Errorf("failed to encode notification: %v", err)
+			return
+		}
+		// Without awaiting an ack - it is still stored on the notifications
+		// stream, as the reactor's are
+		err = nc.Publish(shared.NotificationSubject(sessionId, commandId), bytes)
+		if err == nil {
+			err = nc.Flush()
+		}
+		if err != nil {
+			tb.Errorf("failed to publish notification: %v", err)
+			return
+		}
+		notified <- struct{}{}
+	})
+	if err != nil {
+		tb.Fatalf("failed to subscribe to commands: %v", err)
+	}
+	tb.Cleanup(func() { _ = sub.Unsubscribe() })
+
+	err = nc.Flush()
+	if err != nil {
+		tb.Fatalf("failed to flush subscription: %v", err)
+	}
+	return notified
+}
+
+// createLocation submits a command to create a new location, awaiting its
+// notification
+func createLocation(tb testing.TB, controller *LocationController, header http.Header) CommandAcceptedResponse {
+	tb.Helper()
+
+	body, err := json.Marshal(CreateLocationPayload{Name: "Somewhere", Category: "Town", Description: "Test"})
+	if err != nil {
+		tb.Fatalf("failed to encode payload: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/location/create", bytes.NewReader(body))
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	r.Header.Set(shared.NotificationAwaitHeader, "true")
+
+	w := httptest.NewRecorder()
+	controller.CreateLocationHandler(w, r)
+
+	if w.Code != http.StatusAccepted {
+		tb.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, w.Code, w.Body)
+	}
+
+	response := CommandAcceptedResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		tb.Fatalf("failed to decode response: %v", err)
+	}
+	return response
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+)
+
+//------------------------------------------------------------------------------
+
+var (
+	ErrInvalidSessionToken = errors.New("invalid session token")
+	ErrInvalidStreamToken  = errors.New("invalid stream token")
+)
+
+// SessionResponse is the response of POST /session
+type SessionResponse struct {
+	SessionToken string `json:"session_token"`
+}
+
+// Sessions issues & verifies session tokens: a random session id, signed with
+// the server's secret. Clients can't pick their own session id, so can only
+// subscribe to the notifications of a session they were issued.
+//
+// It also issues stream tokens, which let the client that submitted a command
+// subscribe to that command's notifications. Command ids can be derived from
+// an idempotency key, so knowing one isn't enough.
+type Sessions struct {
+	secret []byte
+}
+
+// NewSessions signs tokens with the secret. Without one, a random secret is
+// used - so tokens are only valid for this process.
+func NewSessions(secret string) (*Sessions, error) {
+	if secret != "" {
+		return &Sessions{secret: []byte(secret)}, nil
+	}
+
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+	return &Sessions{secret: random}, nil
+}
+
+// Issue returns the token for a new session
+func (s *Sessions) Issue() string {
+	sessionId := uuid.NewString()
+	return sessionId + "." + s.sign(sessionId)
+}
+
+// Verify returns the session id of the token, if it was issued by us
+func (s *Sessions) Verify(token string) (string, error) {
+	sessionId, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(sessionId))) {
+		return "", ErrInvalidSessionToken
+	}
+	return sessionId, nil
+}
+
+// IssueStreamToken returns the token for subscribing to the command's
+// notifications
+func (s *Sessions) IssueStreamToken(commandId uuid.UUID) string {
+	return s.sign(commandStreamId(commandId))
+}
+
+// VerifyStreamToken checks the token was issued by us for the command
+func (s *Sessions) VerifyStreamToken(commandId uuid.UUID, token string) error {
+	if !hmac.Equal([]byte(token), []byte(s.sign(commandStreamId(commandId)))) {
+		return ErrInvalidStreamToken
+	}
+	return nil
+}
+
+// sign signs either a session id, or the stream id of a command - which are
+// prefixed, so that one can't be passed off as the other
+func (s *Sessions) sign(value string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IssueHandler starts a new session, whose token is then sent with commands
+// (in the `X-Session-Token` header) & used to subscribe to their notifications
+func (s *Sessions) IssueHandler(w http.ResponseWriter, r *http.Request) {
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, SessionResponse{SessionToken: s.Issue()})
+}
@@ -0,0 +1,307 @@
+package shared
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+//------------------------------------------------------------------------------
+
+// ErrCommandRejected is wrapped by every error that is caused by a command
+// breaking an invariant - retrying the command will never succeed
+var ErrCommandRejected = errors.New("command rejected")
+
+var (
+	ErrLocationExists        = fmt.Errorf("%w: location already exists", ErrCommandRejected)
+	ErrLocationDoesNotExist  = fmt.Errorf("%w: location does not exist", ErrCommandRejected)
+	ErrDuplicateLocationName = fmt.Errorf("%w: location name is already in use", ErrCommandRejected)
+)
+
+// VersionConflictError is returned when a command expects the aggregate to be
+// at a different version than it is
+type VersionConflictError struct {
+	Expected uint64
+	Current  uint64
+}
+
+func (e VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict: expected version %d, but is at %d", e.Expected, e.Current)
+}
+
+func (e VersionConflictError) Unwrap() error {
+	return ErrCommandRejected
+}
+
+// LocationAggregate is the write model of a Location, rehydrated from its
+// event history. It decides which events (if any) a command results in.
+type LocationAggregate struct {
+	Location Location
+	Exists   bool
+	// Version is the stream sequence of the last applied event
+	Version uint64
+
+	commands map[uuid.UUID]*recordedCommand
+}
+
+// recordedCommand is how much of a command's events were appended. A command
+// whose append failed part way through has some, but not its completing event.
+type recordedCommand struct {
+	events    int
+	completed bool
+	// before is the version of the aggregate before the command's first event
+	before uint64
+}
+
+// LoadLocationAggregate rehydrates the aggregate from the event store
+func LoadLocationAggregate(ctx context.Context, store *EventStore, id uuid.UUID) (*LocationAggregate, error) {
+	history, err := store.Load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	aggregate := &LocationAggregate{
+		Location: Location{Id: id},
+		commands: map[uuid.UUID]*recordedCommand{},
+	}
+	for _, recorded := range history {
+		aggregate.Apply(recorded)
+	}
+	return aggregate, nil
+}
+
+func (a *LocationAggregate) Apply(recorded RecordedEvent) {
+	switch recorded.Event.(type) {
+	case LocationCreated:
+		a.Exists = true
+	case LocationDeleted:
+		a.Exists = false
+	}
+
+	command, ok := a.commands[recorded.CorrelationId]
+	if !ok {
+		command = &recordedCommand{before: a.Version}
+		a.commands[recorded.CorrelationId] = command
+	}
+	command.events++
+	command.completed = recorded.CommandCompleted
+
+	a.Location.Apply(recorded.Event)
+	a.Location.Version = recorded.Sequence
+	a.Version = recorded.Sequence
+}
+
+// Handled reports whether all events were already recorded for the command,
+// ie. when it is redelivered after its completing event was appended
+func (a *LocationAggregate) Handled(commandId uuid.UUID) bool {
+	command, ok := a.commands[commandId]
+	return ok && command.completed
+}
+
+// RecordedEvents is the number of events recorded for a command that was only
+// partially appended. Deciding it again against the current state results in
+// just the events that are still missing.
+func (a *LocationAggregate) RecordedEvents(commandId uuid.UUID) int {
+	command, ok := a.commands[commandId]
+	if !ok || command.completed {
+		return 0
+	}
+	return command.events
+}
+
+func (a *LocationAggregate) HandleCreate(command CreateLocationCommand) ([]Event, error) {
+	if a.Exists {
+		return nil, ErrLocationExists
+	}
+
+	return []Event{
+		LocationCreated{
+			Id:          command.Id,
+			Name:        command.Name,
+			Category:    command.Category,
+			Description: command.Description,
+			OccurredAt:  command.CreatedAt,
+		},
+	}, nil
+}
+
+// HandleUpdate results in an event per field that actually changed
+func (a *LocationAggregate) HandleUpdate(command UpdateLocationCommand) ([]Event, error) {
+	if !a.Exists {
+		return nil, ErrLocationDoesNotExist
+	}
+	if err := a.checkVersion(command.CommandId(), command.ExpectedVersion); err != nil {
+		return nil, err
+	}
+
+	events := []Event{}
+	if command.Name != nil && *command.Name != a.Location.Name {
+		events = append(events, LocationRenamed{
+			Id:         command.LocationId,
+			Name:       *command.Name,
+			OccurredAt: command.UpdatedAt,
+		})
+	}
+	if command.Category != nil && *command.Category != a.Location.Category {
+		events = append(events, LocationRecategorised{
+			Id:         command.LocationId,
+			Category:   *command.Category,
+			OccurredAt: command.UpdatedAt,
+		})
+	}
+	if command.Description != nil && *command.Description != a.Location.Description {
+		events = append(events, LocationDescriptionChanged{
+			Id:          command.LocationId,
+			Description: *command.Description,
+			OccurredAt:  command.UpdatedAt,
+		})
+	}
+	return events, nil
+}
+
+func (a *LocationAggregate) HandleDelete(command DeleteLocationCommand) ([]Event, error) {
+	if !a.Exists {
+		return nil, ErrLocationDoesNotExist
+	}
+	if err := a.checkVersion(command.CommandId(), command.ExpectedVersion); err != nil {
+		return nil, err
+	}
+
+	return []Event{
+		LocationDeleted{
+			Id:         command.LocationId,
+			OccurredAt: command.DeletedAt,
+		},
+	}, nil
+}
+
+// checkVersion enforces the version a command expects, if it has one. A
+// partially appended command is checked against the version before its first
+// event, which is what it expected.
+func (a *LocationAggregate) checkVersion(commandId uuid.UUID, expected *uint64) error {
+	version := a.Version
+	if command, ok := a.commands[commandId]; ok && !command.completed {
+		version = command.before
+	}
+
+	if expected == nil || *expected == version {
+		return nil
+	}
+	return VersionConflictError{Expected: *expected, Current: a.Version}
+}
+
+//------------------------------------------------------------------------------
+
+// LocationNameIndex reserves location names across all aggregates, as a single
+// aggregate's history cannot tell whether another location uses a name.
+//
+// Each reservation records the command that made it, as it is made before the
+// command's events are appended: if they never are, the command can then free
+// just the names it reserved.
+type LocationNameIndex struct {
+	kv jetstream.KeyValue
+}
+
+// locationNameReservation is the value of a name's key
+type locationNameReservation struct {
+	LocationId uuid.UUID `json:"location_id"`
+	CommandId  uuid.UUID `json:"command_id"`
+}
+
+func NewLocationNameIndex(kv jetstream.KeyValue) *LocationNameIndex {
+	return &LocationNameIndex{kv: kv}
+}
+
+// Reserve claims the name for the location, on behalf of the command.
+// Reserving a name the location already holds is a no-op, so a redelivered
+// command takes back what it reserved before.
+func (i *LocationNameIndex) Reserve(ctx context.Context, name string, id uuid.UUID, commandId uuid.UUID) error {
+	key := locationNameKey(name)
+
+	value, err := json.Marshal(locationNameReservation{LocationId: id, CommandId: commandId})
+	if err != nil {
+		return err
+	}
+	_, err = i.kv.Create(ctx, key, value)
+	if !errors.Is(err, jetstream.ErrKeyExists) {
+		return err
+	}
+
+	reservation, _, err := i.get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if reservation.LocationId != id {
+		return ErrDuplicateLocationName
+	}
+	return nil
+}
+
+// Release frees the name, if it is held by the location
+func (i *LocationNameIndex) Release(ctx context.Context, name string, id uuid.UUID) error {
+	return i.release(ctx, name, func(reservation locationNameReservation) bool {
+		return reservation.LocationId == id
+	})
+}
+
+// Unreserve frees the name, if it was reserved by the command
+func (i *LocationNameIndex) Unreserve(ctx context.Context, name string, commandId uuid.UUID) error {
+	return i.release(ctx, name, func(reservation locationNameReservation) bool {
+		return reservation.CommandId == commandId
+	})
+}
+
+func (i *LocationNameIndex) release(ctx context.Context, name string, held func(locationNameReservation) bool) error {
+	key := locationNameKey(name)
+
+	reservation, revision, err := i.get(ctx, key)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !held(reservation) {
+		return nil
+	}
+	return i.kv.Delete(ctx, key, jetstream.LastRevision(revision))
+}
+
+// get reads the reservation, which was only the location id before the
+// reserving command was recorded
+func (i *LocationNameIndex) get(ctx context.Context, key string) (locationNameReservation, uint64, error) {
+	reservation := locationNameReservation{}
+
+	entry, err := i.kv.Get(ctx, key)
+	if err != nil {
+		return reservation, 0, err
+	}
+
+	if id, err := uuid.ParseBytes(entry.Value()); err == nil {
+		reservation.LocationId = id
+		return reservation, entry.Revision(), nil
+	}
+	err = json.Unmarshal(entry.Value(), &reservation)
+	if err != nil {
+		return reservation, 0, fmt.Errorf("failed to decode location name reservation: %w", err)
+	}
+	return reservation, entry.Revision(), nil
+}
+
+// SameLocationName reports whether both names claim the same reservation
+func SameLocationName(a string, b string) bool {
+	return locationNameKey(a) == locationNameKey(b)
+}
+
+// Names are compared case-insensitively, and hashed to fit the KV key charset
+func locationNameKey(name string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(name))))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,64 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+//------------------------------------------------------------------------------
+
+// A command whose append failed after its first event is decided again against
+// the version it expected, resulting in just the events that are still missing
+func TestLocationAggregatePartiallyAppendedCommand(t *testing.T) {
+	id := uuid.New()
+	aggregate := &LocationAggregate{Location: Location{Id: id}, commands: map[uuid.UUID]*recordedCommand{}}
+	aggregate.Apply(RecordedEvent{
+		Event:            LocationCreated{Id: id, Name: "one", Category: "Town"},
+		Sequence:         1,
+		CorrelationId:    uuid.New(),
+		CommandCompleted: true,
+	})
+
+	name, category := "two", "City"
+	expected := uint64(1)
+	command := UpdateLocationCommand{Id: uuid.New(), LocationId: id, Name: &name, Category: &category, ExpectedVersion: &expected}
+
+	// Only the rename made it onto the stream
+	aggregate.Apply(RecordedEvent{
+		Event:         LocationRenamed{Id: id, Name: name},
+		Sequence:      2,
+		CorrelationId: command.Id,
+	})
+
+	if aggregate.Handled(command.Id) {
+		t.Fatal("expected a partially appended command not to be handled")
+	}
+	if recorded := aggregate.RecordedEvents(command.Id); recorded != 1 {
+		t.Fatalf("expected 1 recorded event, got %d", recorded)
+	}
+
+	events, err := aggregate.HandleUpdate(command)
+	if err != nil {
+		t.Fatalf("failed to decide the command again: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected only the missing event, got %v", events)
+	}
+	if _, ok := events[0].(LocationRecategorised); !ok {
+		t.Fatalf("expected LocationRecategorised, got %T", events[0])
+	}
+
+	aggregate.Apply(RecordedEvent{
+		Event:            events[0],
+		Sequence:         3,
+		CorrelationId:    command.Id,
+		CommandCompleted: true,
+	})
+	if !aggregate.Handled(command.Id) {
+		t.Fatal("expected the command to be handled once its completing event was recorded")
+	}
+	if _, err := aggregate.HandleUpdate(command); err == nil {
+		t.Fatal("expected the completed command's expected version to conflict")
+	}
+}
@@ -0,0 +1,167 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+//------------------------------------------------------------------------------
+
+var (
+	ErrUnknownCommand   = errors.New("unknown command")
+	ErrNoCommandHandler = errors.New("no handler registered for command")
+	// ErrMalformedMessage is wrapped by errors decoding a command or event
+	ErrMalformedMessage = errors.New("failed to decode")
+)
+
+// Command is implemented by everything that can be sent over the CommandBus
+type Command interface {
+	// CommandName is the name the command is registered & published under
+	CommandName() string
+	// CommandId is the id that notifications for the command are correlated to
+	CommandId() uuid.UUID
+	// AggregateId is the id of the resource the command applies to
+	AggregateId() uuid.UUID
+}
+
+// CommandHandler applies a decoded command. The original message is passed
+// through for access to its headers & metadata.
+type CommandHandler[C Command] func(ctx context.Context, msg jetstream.Msg, command C) error
+
+type commandRegistration struct {
+	decode func(data []byte) (Command, error)
+	handle func(ctx context.Context, msg jetstream.Msg, command Command) error
+}
+
+// CommandBus is a registry of commands, mapping their names to Go types and
+// (optionally) handlers.
+//
+// The same registrations are used to publish commands and to dispatch them,
+// so that both sides agree on subjects & payloads. Commands are published on
+// `commands.<aggregate id>.<command name>`, with the name also set in the
+// CommandHeader, and the command id in the CommandIdHeader (so that it is known
+// even if the payload cannot be decoded).
+type CommandBus struct {
+	js       jetstream.JetStream
+	commands map[string]*commandRegistration
+}
+
+func NewCommandBus(js jetstream.JetStream) *CommandBus {
+	return &CommandBus{js: js, commands: map[string]*commandRegistration{}}
+}
+
+// RegisterCommand makes the command type known to the bus, without a handler
+func RegisterCommand[C Command](bus *CommandBus) {
+	var zero C
+	name := zero.CommandName()
+	if _, ok := bus.commands[name]; ok {
+		return
+	}
+
+	bus.commands[name] = &commandRegistration{
+		decode: func(data []byte) (Command, error) {
+			var command C
+			err := json.Unmarshal(data, &command)
+			return command, err
+		},
+	}
+}
+
+// HandleCommand registers the command type along with the handler that is
+// invoked when it is dispatched
+func HandleCommand[C Command](bus *CommandBus, handler CommandHandler[C]) {
+	RegisterCommand[C](bus)
+
+	var zero C
+	bus.commands[zero.CommandName()].handle = func(ctx context.Context, msg jetstream.Msg, command Command) error {
+		return handler(ctx, msg, command.(C))
+	}
+}
+
+// Subject returns the subject that the command is published on
+func (b *CommandBus) Subject(command Command) (string, error) {
+	name := command.CommandName()
+	if _, ok := b.commands[name]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownCommand, name)
+	}
+	return CommandSubject(command.AggregateId(), name), nil
+}
+
+// Publish sends the command onto the commands stream
+func (b *CommandBus) Publish(ctx context.Context, command Command, header nats.Header) (*jetstream.PubAck, error) {
+	subject, err := b.Subject(command)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(command)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = bytes
+	for key, values := range header {
+		msg.Header[key] = values
+	}
+	msg.Header.Set(CommandHeader, command.CommandName())
+	msg.Header.Set(CommandIdHeader, command.CommandId().String())
+
+	return b.js.PublishMsg(ctx, msg)
+}
+
+// Decode parses the message into its registered command type. The command
+// name is taken from the CommandHeader, falling back to the last subject token.
+func (b *CommandBus) Decode(msg jetstream.Msg) (Command, error) {
+	name := CommandNameFromMsg(msg)
+
+	registration, ok := b.commands[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCommand, name)
+	}
+
+	command, err := registration.decode(msg.Data())
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %w", ErrMalformedMessage, name, err)
+	}
+	return command, nil
+}
+
+// Dispatch decodes the message and invokes the handler for its command
+func (b *CommandBus) Dispatch(ctx context.Context, msg jetstream.Msg) error {
+	command, err := b.Decode(msg)
+	if err != nil {
+		return err
+	}
+
+	registration := b.commands[command.CommandName()]
+	if registration.handle == nil {
+		return fmt.Errorf("%w: %s", ErrNoCommandHandler, command.CommandName())
+	}
+	return registration.handle(ctx, msg, command)
+}
+
+//------------------------------------------------------------------------------
+
+// CommandSubject is the subject that a command is published on
+func CommandSubject(aggregateId uuid.UUID, name string) string {
+	return fmt.Sprintf("%s.%s.%s", StreamSubjectCommands, aggregateId.String(), name)
+}
+
+// CommandNameFromMsg returns the command name of the message, preferring the
+// CommandHeader over the subject
+func CommandNameFromMsg(msg jetstream.Msg) string {
+	if name := msg.Headers().Get(CommandHeader); name != "" {
+		return name
+	}
+
+	subject := msg.Subject()
+	return subject[strings.LastIndex(subject, ".")+1:]
+}
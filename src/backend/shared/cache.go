@@ -0,0 +1,301 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+//------------------------------------------------------------------------------
+
+// The cache is watched again after cacheRewatchDelay, doubling up to
+// cacheRewatchDelayMax while it keeps failing
+const (
+	cacheRewatchDelay    = 250 * time.Millisecond
+	cacheRewatchDelayMax = 30 * time.Second
+)
+
+// CachedLocationsRepository serves reads from an in-memory copy of a locations
+// bucket, which a watcher keeps current. Writes go to the repository it wraps,
+// and are then picked up by the watcher.
+//
+// Reads lag behind writes until the watcher receives them, so it is only fit
+// for queries - not for the projector, which reads what it writes.
+type CachedLocationsRepository struct {
+	repo   LocationsRepository
+	kv     jetstream.KeyValue
+	logger *slog.Logger
+
+	mu        sync.RWMutex
+	locations map[uuid.UUID]Location
+	// revision is the last revision of the bucket the cache reflects
+	revision uint64
+	// live is false until loaded, and while the watcher is stopped - when reads
+	// go to the wrapped repository instead
+	live bool
+	stop context.CancelFunc
+	// updated is closed & replaced whenever the revision changes
+	updated chan struct{}
+}
+
+func NewCachedLocationsRepository(repo LocationsRepository, kv jetstream.KeyValue, logger *slog.Logger) *CachedLocationsRepository {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &CachedLocationsRepository{
+		repo:      repo,
+		kv:        kv,
+		logger:    logger,
+		locations: map[uuid.UUID]Location{},
+		stop:      func() {},
+		updated:   make(chan struct{}),
+	}
+}
+
+// Load reads every location into memory, then keeps them current in the
+// background until Stop is called
+func (c *CachedLocationsRepository) Load(ctx context.Context) error {
+	watchCtx, stop := context.WithCancel(context.Background())
+
+	loaded := make(chan error, 1)
+	go c.run(watchCtx, loaded)
+
+	var err error
+	select {
+	case err = <-loaded:
+	case <-ctx.Done():
+		err = kvError(ctx.Err())
+	}
+	if err != nil {
+		stop()
+		return err
+	}
+
+	c.mu.Lock()
+	c.stop = stop
+	c.mu.Unlock()
+	return nil
+}
+
+// Stop stops keeping the cache current, and serves reads from the wrapped
+// repository from then on
+func (c *CachedLocationsRepository) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stop()
+	c.live = false
+	c.notify()
+}
+
+// notify wakes up anything waiting for the cache to change. It must be called
+// with the lock held.
+func (c *CachedLocationsRepository) notify() {
+	close(c.updated)
+	c.updated = make(chan struct{})
+}
+
+// run watches the bucket until the context is cancelled. If the watcher stops
+// once loaded (ie. its subscription was closed, or the bucket deleted), reads
+// go to the wrapped repository while it is re-created with a backoff. Failing
+// to load in the first place is reported to Load instead.
+func (c *CachedLocationsRepository) run(ctx context.Context, loaded chan<- error) {
+	delay := cacheRewatchDelay
+	for {
+		watcher, err := c.kv.WatchAll(ctx)
+		if err == nil {
+			stopped := context.AfterFunc(ctx, func() { _ = watcher.Stop() })
+			if c.watch(ctx, watcher, loaded) {
+				loaded = nil
+				delay = cacheRewatchDelay
+			}
+			stopped()
+			_ = watcher.Stop()
+		}
+
+		if loaded != nil {
+			if err == nil {
+				err = fmt.Errorf("%w: watcher stopped before loading", ErrUnavailable)
+			}
+			loaded <- kvError(err)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		c.logger.Warn("Stopped caching Locations, watching again", "bucket", c.kv.Bucket(), "delay", delay, "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay = min(delay*2, cacheRewatchDelayMax)
+	}
+}
+
+// watch applies the watcher's updates until it stops, reporting whether every
+// location was loaded
+func (c *CachedLocationsRepository) watch(ctx context.Context, watcher jetstream.KeyWatcher, loaded chan<- error) bool {
+	// Whatever was deleted while not watching is only left out by starting over
+	c.mu.Lock()
+	c.locations = map[uuid.UUID]Location{}
+	c.revision = 0
+	c.mu.Unlock()
+
+	initialised := false
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			// Every current value has been received - unless stopped meanwhile
+			c.mu.Lock()
+			c.live = ctx.Err() == nil
+			count, revision := len(c.locations), c.revision
+			c.notify()
+			c.mu.Unlock()
+
+			c.logger.Info("Loaded Locations into cache", "bucket", c.kv.Bucket(), "count", count, "revision", revision)
+			initialised = true
+			if loaded != nil {
+				loaded <- nil
+			}
+			continue
+		}
+
+		err := c.apply(entry)
+		if err != nil {
+			c.logger.Error("Failed to cache Location", "key", entry.Key(), "revision", entry.Revision(), "err", err)
+		}
+	}
+
+	// The watcher was stopped, or its subscription was closed
+	c.mu.Lock()
+	c.live = false
+	c.notify()
+	c.mu.Unlock()
+	return initialised
+}
+
+func (c *CachedLocationsRepository) apply(entry jetstream.KeyValueEntry) error {
+	id, err := uuid.Parse(entry.Key())
+	if err != nil {
+		return err
+	}
+
+	stored := kvLocation{Deleted: true}
+	if entry.Operation() == jetstream.KeyValuePut {
+		stored, err = decodeKvLocation(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !stored.Deleted {
+		c.locations[id] = stored.Location
+	} else {
+		delete(c.locations, id)
+	}
+	c.revision = max(c.revision, entry.Revision())
+	c.notify()
+	return nil
+}
+
+// Revision is the last revision of the bucket that reads reflect, or zero if
+// they aren't being served from memory
+func (c *CachedLocationsRepository) Revision() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.live {
+		return 0
+	}
+	return c.revision
+}
+
+// Sync waits until the cache reflects every write to the bucket so far, so that
+// reads from it are as current as reads from the bucket would be
+func (c *CachedLocationsRepository) Sync(ctx context.Context) error {
+	status, err := c.kv.Status(ctx)
+	if err != nil {
+		return kvError(err)
+	}
+	bucketStatus, ok := status.(*jetstream.KeyValueBucketStatus)
+	if !ok {
+		return nil
+	}
+	target := bucketStatus.StreamInfo().State.LastSeq
+
+	for {
+		c.mu.RLock()
+		reached := !c.live || c.revision >= target
+		updated := c.updated
+		c.mu.RUnlock()
+
+		if reached {
+			return nil
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return kvError(ctx.Err())
+		}
+	}
+}
+
+func (c *CachedLocationsRepository) GetLocation(ctx context.Context, id uuid.UUID) (*Location, error) {
+	c.mu.RLock()
+	location, ok := c.locations[id]
+	live := c.live
+	c.mu.RUnlock()
+
+	if !live {
+		return c.repo.GetLocation(ctx, id)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: location %s", ErrNotFound, id)
+	}
+	return &location, nil
+}
+
+func (c *CachedLocationsRepository) ListLocations(ctx context.Context, query LocationsQuery) (*LocationsPage, error) {
+	c.mu.RLock()
+	if !c.live {
+		c.mu.RUnlock()
+		return c.repo.ListLocations(ctx, query)
+	}
+
+	locations := []Location{}
+	for _, location := range c.locations {
+		if query.Matches(location) {
+			locations = append(locations, location)
+		}
+	}
+	revision := c.revision
+	c.mu.RUnlock()
+
+	page := query.Page(locations)
+	page.Revision = revision
+	return page, nil
+}
+
+func (c *CachedLocationsRepository) CreateLocation(ctx context.Context, location Location) error {
+	return c.repo.CreateLocation(ctx, location)
+}
+
+func (c *CachedLocationsRepository) UpdateLocation(ctx context.Context, location Location) error {
+	return c.repo.UpdateLocation(ctx, location)
+}
+
+func (c *CachedLocationsRepository) DeleteLocation(ctx context.Context, id uuid.UUID, version uint64) error {
+	return c.repo.DeleteLocation(ctx, id, version)
+}
+
+// Interface assertion
+var _ LocationsRepository = (*CachedLocationsRepository)(nil)
@@ -0,0 +1,221 @@
+package shared_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/natstest"
+	"nats_cqrs/shared"
+)
+
+//------------------------------------------------------------------------------
+
+// Compares listing a page of locations from the cache against reading every
+// key from KV, as listing did before the cache
+func BenchmarkListLocations(b *testing.B) {
+	const count = 5000
+
+	s := natstest.RunServer(b)
+	_, js := natstest.Connect(b, s)
+	ctx := context.Background()
+
+	kv, err := js.CreateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: "bench_locations", Storage: jetstream.MemoryStorage})
+	if err != nil {
+		b.Fatalf("failed to create bucket: %v", err)
+	}
+
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	kvRepo := shared.NewNatsKvLocationsRepository(kv, quiet)
+	seedLocations(b, kvRepo, count)
+
+	cache := shared.NewCachedLocationsRepository(kvRepo, kv, quiet)
+	err = cache.Load(ctx)
+	if err != nil {
+		b.Fatalf("failed to load cache: %v", err)
+	}
+	b.Cleanup(cache.Stop)
+
+	query := shared.LocationsQuery{Sort: shared.SortByCreatedAt, Descending: true, Limit: 100}
+	for _, bench := range []struct {
+		name string
+		list func(ctx context.Context, query shared.LocationsQuery) (*shared.LocationsPage, error)
+	}{
+		{"kv-get", func(ctx context.Context, query shared.LocationsQuery) (*shared.LocationsPage, error) {
+			return listByKey(ctx, kv, query)
+		}},
+		{"kv-watch", kvRepo.ListLocations},
+		{"cache", cache.ListLocations},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				page, err := bench.list(ctx, query)
+				if err != nil {
+					b.Fatalf("failed to list locations: %v", err)
+				}
+				if len(page.Locations) != query.Limit {
+					b.Fatalf("expected %d locations, got %d", query.Limit, len(page.Locations))
+				}
+			}
+		})
+	}
+}
+
+// Once its watcher stops, the cache falls back to the bucket until it has
+// watched it again, rather than serving what it last saw
+func TestCachedLocationsRepositoryWatchesAgain(t *testing.T) {
+	s := natstest.RunServer(t)
+	_, js := natstest.Connect(t, s)
+	ctx := context.Background()
+
+	kv, err := js.CreateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: "locations", Storage: jetstream.MemoryStorage})
+	if err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+	watched := &watchedKv{KeyValue: kv}
+
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cache := shared.NewCachedLocationsRepository(shared.NewNatsKvLocationsRepository(kv, quiet), watched, quiet)
+	err = cache.Load(ctx)
+	if err != nil {
+		t.Fatalf("failed to load cache: %v", err)
+	}
+	defer cache.Stop()
+
+	watched.stopLast()
+	location := shared.Location{Id: uuid.New(), Name: "Written meanwhile", Category: "Town", CreatedAt: time.Now(), Version: 1}
+	err = cache.CreateLocation(ctx, location)
+	if err != nil {
+		t.Fatalf("failed to create location: %v", err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); cache.Revision() == 0; {
+		// Meanwhile, reads go to the bucket
+		_, err := cache.GetLocation(ctx, location.Id)
+		if err != nil {
+			t.Fatalf("expected to read the location from the bucket: %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cache didn't watch the bucket again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = cache.Sync(ctx)
+	if err != nil {
+		t.Fatalf("failed to sync cache: %v", err)
+	}
+	_, err = cache.GetLocation(ctx, location.Id)
+	if err != nil {
+		t.Fatalf("expected the cache to have the location: %v", err)
+	}
+	if watched.count() < 2 {
+		t.Fatalf("expected the bucket to be watched again, got %d watchers", watched.count())
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// seedLocations writes the locations a few at a time
+func seedLocations(tb testing.TB, repo shared.LocationsRepository, count int) {
+	tb.Helper()
+
+	var (
+		wg      sync.WaitGroup
+		indexes = make(chan int)
+		now     = time.Now()
+	)
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				err := repo.CreateLocation(context.Background(), shared.Location{
+					Id:          uuid.New(),
+					Name:        fmt.Sprintf("Location %d", i),
+					Category:    shared.LocationCategories[i%len(shared.LocationCategories)],
+					Description: "Seeded by benchmark",
+					CreatedAt:   now.Add(time.Duration(i) * time.Second),
+					Version:     1,
+				})
+				if err != nil {
+					tb.Errorf("failed to seed location: %v", err)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// listByKey lists the keys of the bucket, then gets each location in turn
+func listByKey(ctx context.Context, kv jetstream.KeyValue, query shared.LocationsQuery) (*shared.LocationsPage, error) {
+	keys, err := kv.ListKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	locations := []shared.Location{}
+	for key := range keys.Keys() {
+		entry, err := kv.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		stored := struct {
+			shared.Location
+			Deleted bool `json:"deleted"`
+		}{}
+		err = json.Unmarshal(entry.Value(), &stored)
+		if err != nil {
+			return nil, err
+		}
+		if !stored.Deleted && query.Matches(stored.Location) {
+			locations = append(locations, stored.Location)
+		}
+	}
+	return query.Page(locations), nil
+}
+
+// watchedKv keeps the watchers of the bucket, so that a test can stop them as
+// if their subscription was closed
+type watchedKv struct {
+	jetstream.KeyValue
+
+	mu       sync.Mutex
+	watchers []jetstream.KeyWatcher
+}
+
+func (kv *watchedKv) WatchAll(ctx context.Context, opts ...jetstream.WatchOpt) (jetstream.KeyWatcher, error) {
+	watcher, err := kv.KeyValue.WatchAll(ctx, opts...)
+	if err == nil {
+		kv.mu.Lock()
+		kv.watchers = append(kv.watchers, watcher)
+		kv.mu.Unlock()
+	}
+	return watcher, err
+}
+
+func (kv *watchedKv) stopLast() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	_ = kv.watchers[len(kv.watchers)-1].Stop()
+}
+
+func (kv *watchedKv) count() int {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return len(kv.watchers)
+}
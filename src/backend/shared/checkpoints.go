@@ -0,0 +1,67 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+//------------------------------------------------------------------------------
+
+// ProjectedCommand records that every event of a command has been projected
+// into the read model
+type ProjectedCommand struct {
+	CommandId   uuid.UUID `json:"command_id"`
+	AggregateId uuid.UUID `json:"aggregate_id"`
+	// Sequence is the events stream sequence of the command's last event, which
+	// is also the Version of the location it was projected into
+	Sequence    uint64    `json:"sequence"`
+	ProjectedAt time.Time `json:"projected_at"`
+}
+
+// ProjectionCheckpoints records how far the projector has got, so that readers
+// can tell whether what they read is up to date
+type ProjectionCheckpoints struct {
+	kv jetstream.KeyValue
+}
+
+func NewProjectionCheckpoints(kv jetstream.KeyValue) *ProjectionCheckpoints {
+	return &ProjectionCheckpoints{kv: kv}
+}
+
+func (c *ProjectionCheckpoints) RecordCommand(ctx context.Context, projected ProjectedCommand) error {
+	bytes, err := json.Marshal(projected)
+	if err != nil {
+		return err
+	}
+	_, err = c.kv.Put(ctx, projectedCommandKey(projected.CommandId), bytes)
+	return err
+}
+
+// Command looks up whether the command has been projected, returning nil if it
+// hasn't (yet) - or was projected too long ago to remember
+func (c *ProjectionCheckpoints) Command(ctx context.Context, commandId uuid.UUID) (*ProjectedCommand, error) {
+	entry, err := c.kv.Get(ctx, projectedCommandKey(commandId))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	projected := &ProjectedCommand{}
+	err = json.Unmarshal(entry.Value(), projected)
+	if err != nil {
+		return nil, err
+	}
+	return projected, nil
+}
+
+func projectedCommandKey(commandId uuid.UUID) string {
+	return fmt.Sprintf("commands.%s", commandId.String())
+}
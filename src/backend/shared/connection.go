@@ -0,0 +1,70 @@
+package shared
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+
+	"nats_cqrs/config"
+)
+
+//------------------------------------------------------------------------------
+
+// Connect connects to NATS as the named client, logging whenever the
+// connection is lost & re-established
+func Connect(name string, opts config.NatsConfig, logger *slog.Logger) (*nats.Conn, error) {
+	natsOpts := []nats.Option{
+		nats.Name(name),
+		nats.Timeout(opts.ConnectTimeout),
+		nats.MaxReconnects(opts.MaxReconnects),
+		nats.ReconnectWait(opts.ReconnectWait),
+		nats.ReconnectJitter(opts.ReconnectJitter, opts.ReconnectJitter),
+
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			logger.Warn("Disconnected from NATS", "err", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			logger.Info("Reconnected to NATS", "url", nc.ConnectedUrlRedacted())
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			logger.Info("NATS connection closed")
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+			logger.Error("NATS error", "err", err)
+		}),
+	}
+
+	if opts.User != "" {
+		natsOpts = append(natsOpts, nats.UserInfo(opts.User, opts.Password))
+	}
+	if opts.CredsFile != "" {
+		natsOpts = append(natsOpts, nats.UserCredentials(opts.CredsFile))
+	}
+	if opts.NkeySeedFile != "" {
+		nkeyOpt, err := nats.NkeyOptionFromSeed(opts.NkeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load nkey seed: %w", err)
+		}
+		natsOpts = append(natsOpts, nkeyOpt)
+	}
+	if opts.TLSCert != "" || opts.TLSKey != "" {
+		natsOpts = append(natsOpts, nats.ClientCert(opts.TLSCert, opts.TLSKey))
+	}
+	if opts.TLSCA != "" {
+		natsOpts = append(natsOpts, nats.RootCAs(opts.TLSCA))
+	}
+
+	nc, err := nats.Connect(opts.URLs, natsOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info(
+		"Connected to NATS",
+		"url", nc.ConnectedUrlRedacted(),
+		"servers", len(strings.Split(opts.URLs, ",")),
+	)
+	return nc, nil
+}
@@ -0,0 +1,74 @@
+package shared
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+//------------------------------------------------------------------------------
+
+const (
+	StreamSubjectDeadLetter = "deadletter"
+
+	// Headers describing why & where from a message was dead-lettered, added
+	// alongside the original headers
+	DeadLetterStreamHeader     = "X-Dead-Letter-Stream"
+	DeadLetterConsumerHeader   = "X-Dead-Letter-Consumer"
+	DeadLetterSubjectHeader    = "X-Dead-Letter-Subject"
+	DeadLetterSequenceHeader   = "X-Dead-Letter-Sequence"
+	DeadLetterDeliveriesHeader = "X-Dead-Letter-Deliveries"
+	DeadLetterErrorHeader      = "X-Dead-Letter-Error"
+	DeadLetterTimeHeader       = "X-Dead-Letter-Time"
+)
+
+// DeadLetterSubject is the subject that messages given up on by the consumer
+// are published on
+func DeadLetterSubject(streamName string, consumerName string) string {
+	return fmt.Sprintf("%s.%s.%s", StreamSubjectDeadLetter, streamName, consumerName)
+}
+
+// DeadLetterMsg is a copy of the original message, with the failure described
+// in its headers
+func DeadLetterMsg(
+	original jetstream.Msg,
+	streamName string,
+	consumerName string,
+	sequence uint64,
+	deliveries uint64,
+	cause error,
+) *nats.Msg {
+	msg := nats.NewMsg(DeadLetterSubject(streamName, consumerName))
+	msg.Data = original.Data()
+	for key, values := range original.Headers() {
+		msg.Header[key] = values
+	}
+	// The original message id would be dropped as a duplicate
+	msg.Header.Del(nats.MsgIdHdr)
+
+	msg.Header.Set(DeadLetterStreamHeader, streamName)
+	msg.Header.Set(DeadLetterConsumerHeader, consumerName)
+	msg.Header.Set(DeadLetterSubjectHeader, original.Subject())
+	msg.Header.Set(DeadLetterSequenceHeader, fmt.Sprint(sequence))
+	msg.Header.Set(DeadLetterDeliveriesHeader, fmt.Sprint(deliveries))
+	msg.Header.Set(DeadLetterErrorHeader, cause.Error())
+	msg.Header.Set(DeadLetterTimeHeader, time.Now().UTC().Format(time.RFC3339Nano))
+	return msg
+}
+
+// CommandIdFromHeader returns the id of the command a message belongs to -
+// either the command itself, or an event derived from it
+func CommandIdFromHeader(header nats.Header) (uuid.UUID, bool) {
+	for _, key := range []string{CommandIdHeader, CorrelationIdHeader} {
+		if value := header.Get(key); value != "" {
+			id, err := uuid.Parse(value)
+			if err == nil {
+				return id, true
+			}
+		}
+	}
+	return uuid.Nil, false
+}
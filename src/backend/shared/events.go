@@ -0,0 +1,300 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+//------------------------------------------------------------------------------
+
+const (
+	StreamSubjectEvents    = "events"
+	EventHeader            = "X-Event"
+	CorrelationIdHeader    = "X-Correlation-Id"
+	CommandCompletedHeader = "X-Command-Completed"
+)
+
+// Event is a fact about an aggregate, derived from a command
+type Event interface {
+	// EventName is the name the event is published under
+	EventName() string
+	// AggregateId is the id of the aggregate the event belongs to
+	AggregateId() uuid.UUID
+}
+
+type LocationCreated struct {
+	Id          uuid.UUID `json:"id"`
+	Name        string    `json:"name"`
+	Category    string    `json:"category"`
+	Description string    `json:"description"`
+	OccurredAt  time.Time `json:"occurred_at"`
+}
+
+func (e LocationCreated) EventName() string      { return "LocationCreated" }
+func (e LocationCreated) AggregateId() uuid.UUID { return e.Id }
+
+type LocationRenamed struct {
+	Id         uuid.UUID `json:"id"`
+	Name       string    `json:"name"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+func (e LocationRenamed) EventName() string      { return "LocationRenamed" }
+func (e LocationRenamed) AggregateId() uuid.UUID { return e.Id }
+
+type LocationRecategorised struct {
+	Id         uuid.UUID `json:"id"`
+	Category   string    `json:"category"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+func (e LocationRecategorised) EventName() string      { return "LocationRecategorised" }
+func (e LocationRecategorised) AggregateId() uuid.UUID { return e.Id }
+
+type LocationDescriptionChanged struct {
+	Id          uuid.UUID `json:"id"`
+	Description string    `json:"description"`
+	OccurredAt  time.Time `json:"occurred_at"`
+}
+
+func (e LocationDescriptionChanged) EventName() string      { return "LocationDescriptionChanged" }
+func (e LocationDescriptionChanged) AggregateId() uuid.UUID { return e.Id }
+
+type LocationDeleted struct {
+	Id         uuid.UUID `json:"id"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+func (e LocationDeleted) EventName() string      { return "LocationDeleted" }
+func (e LocationDeleted) AggregateId() uuid.UUID { return e.Id }
+
+var ErrUnknownEvent = errors.New("unknown event")
+
+var eventDecoders = map[string]func(data []byte) (Event, error){}
+
+func registerEvent[E Event]() {
+	var zero E
+	eventDecoders[zero.EventName()] = func(data []byte) (Event, error) {
+		var event E
+		err := json.Unmarshal(data, &event)
+		return event, err
+	}
+}
+
+func init() {
+	registerEvent[LocationCreated]()
+	registerEvent[LocationRenamed]()
+	registerEvent[LocationRecategorised]()
+	registerEvent[LocationDescriptionChanged]()
+	registerEvent[LocationDeleted]()
+}
+
+// ErrConcurrentModification is returned when another event was appended to
+// the aggregate after it was loaded
+var ErrConcurrentModification = errors.New("aggregate was modified concurrently")
+
+// EventSubject is the subject that the events of an aggregate are published
+// on. Keeping the whole history on a single subject lets the stream enforce
+// the expected version of the aggregate when appending.
+func EventSubject(aggregateId uuid.UUID) string {
+	return fmt.Sprintf("%s.%s", StreamSubjectEvents, aggregateId.String())
+}
+
+// StoredEventSubject matches the subject that the events of an aggregate are
+// stored on, once the stream has put them in its partition (see topology)
+func StoredEventSubject(aggregateId uuid.UUID) string {
+	return fmt.Sprintf("%s.*.%s", StreamSubjectEvents, aggregateId.String())
+}
+
+//------------------------------------------------------------------------------
+
+// RecordedEvent is an event as it was stored on the events stream
+type RecordedEvent struct {
+	Event    Event
+	Sequence uint64
+	// CorrelationId is the id of the command the event was derived from
+	CorrelationId uuid.UUID
+	// CommandCompleted is set on the last event derived from a command
+	CommandCompleted bool
+	Header           nats.Header
+}
+
+// DecodeRecordedEvent parses the message into its registered event type, which
+// is named by the EventHeader
+func DecodeRecordedEvent(msg jetstream.Msg) (RecordedEvent, error) {
+	recorded := RecordedEvent{Header: msg.Headers()}
+
+	meta, err := msg.Metadata()
+	if err != nil {
+		return recorded, err
+	}
+	recorded.Sequence = meta.Sequence.Stream
+
+	name := msg.Headers().Get(EventHeader)
+
+	decode, ok := eventDecoders[name]
+	if !ok {
+		return recorded, fmt.Errorf("%w: %s", ErrUnknownEvent, name)
+	}
+
+	recorded.Event, err = decode(msg.Data())
+	if err != nil {
+		return recorded, fmt.Errorf("%w %s: %w", ErrMalformedMessage, name, err)
+	}
+
+	if correlationId := msg.Headers().Get(CorrelationIdHeader); correlationId != "" {
+		recorded.CorrelationId, err = uuid.Parse(correlationId)
+		if err != nil {
+			return recorded, fmt.Errorf("%w: invalid %s header: %w", ErrMalformedMessage, CorrelationIdHeader, err)
+		}
+	}
+	recorded.CommandCompleted, _ = strconv.ParseBool(msg.Headers().Get(CommandCompletedHeader))
+
+	return recorded, nil
+}
+
+// EventStore reads & appends aggregate events on the events stream
+type EventStore struct {
+	js         jetstream.JetStream
+	streamName string
+	logger     *slog.Logger
+}
+
+func NewEventStore(js jetstream.JetStream, streamName string, logger *slog.Logger) *EventStore {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &EventStore{js: js, streamName: streamName, logger: logger}
+}
+
+// Load reads the full event history of the aggregate
+func (s *EventStore) Load(ctx context.Context, aggregateId uuid.UUID) ([]RecordedEvent, error) {
+	msgs, err := ReadStream(ctx, s.js, s.streamName, StoredEventSubject(aggregateId), 1)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]RecordedEvent, 0, len(msgs))
+	for _, msg := range msgs {
+		event, err := DecodeRecordedEvent(msg)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// Append publishes the events derived from the command, provided that the
+// aggregate is still at the expected version (the stream sequence of its last
+// event), and returns its new version. Headers of the command (ie. the session
+// id) are carried over onto each event. Also returns how many of the events
+// were appended, as an error can leave the command partially appended.
+//
+// Each event has a message id derived from the command & its position amongst
+// the command's events, so that re-appending after a redelivered command is
+// dropped by the stream's duplicate window. recorded is the number of the
+// command's events that were already appended before.
+func (s *EventStore) Append(ctx context.Context, command Command, events []Event, recorded int, expectedVersion uint64, header nats.Header) (uint64, int, error) {
+	version := expectedVersion
+
+	for i, event := range events {
+		msg := nats.NewMsg(EventSubject(event.AggregateId()))
+
+		bytes, err := json.Marshal(event)
+		if err != nil {
+			return version, i, err
+		}
+		msg.Data = bytes
+
+		if sessionId := header.Get(SessionIdHeader); sessionId != "" {
+			msg.Header.Set(SessionIdHeader, sessionId)
+		}
+		msg.Header.Set(EventHeader, event.EventName())
+		msg.Header.Set(CorrelationIdHeader, command.CommandId().String())
+		if i == len(events)-1 {
+			msg.Header.Set(CommandCompletedHeader, "true")
+		}
+
+		ack, err := s.js.PublishMsg(
+			ctx,
+			msg,
+			jetstream.WithMsgID(fmt.Sprintf("%s-%d", command.CommandId(), recorded+i)),
+			jetstream.WithExpectLastSequencePerSubject(version),
+		)
+		var apiErr *jetstream.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence {
+			return version, i, fmt.Errorf("%w: expected version %d", ErrConcurrentModification, version)
+		}
+		if err != nil {
+			return version, i, err
+		}
+		version = ack.Sequence
+
+		s.logger.Debug(
+			"Appended event",
+			"event", event.EventName(),
+			"id", event.AggregateId(),
+			"seq", ack.Sequence,
+			"duplicate", ack.Duplicate,
+		)
+	}
+	return version, len(events), nil
+}
+
+//------------------------------------------------------------------------------
+
+// ReadStream reads every message on the stream matching the filter, starting
+// at the given sequence, using a short-lived ephemeral consumer
+func ReadStream(ctx context.Context, js jetstream.JetStream, streamName string, filterSubject string, startSeq uint64) ([]jetstream.Msg, error) {
+	msgs := []jetstream.Msg{}
+
+	consumer, err := js.CreateConsumer(ctx, streamName, jetstream.ConsumerConfig{
+		FilterSubject:     filterSubject,
+		DeliverPolicy:     jetstream.DeliverByStartSequencePolicy,
+		OptStartSeq:       max(startSeq, 1),
+		AckPolicy:         jetstream.AckNonePolicy,
+		InactiveThreshold: 30 * time.Second,
+		MemoryStorage:     true,
+	})
+	if err != nil {
+		return msgs, err
+	}
+
+	info := consumer.CachedInfo()
+	defer func() {
+		_ = js.DeleteConsumer(context.Background(), streamName, info.Name)
+	}()
+
+	pending := int(info.NumPending)
+	for pending > 0 {
+		batch, err := consumer.Fetch(min(pending, 100), jetstream.FetchMaxWait(time.Second))
+		if err != nil {
+			return msgs, err
+		}
+
+		received := 0
+		for msg := range batch.Messages() {
+			received++
+			msgs = append(msgs, msg)
+		}
+		if batch.Error() != nil {
+			return msgs, batch.Error()
+		}
+		if received == 0 {
+			break
+		}
+		pending -= received
+	}
+
+	return msgs, nil
+}
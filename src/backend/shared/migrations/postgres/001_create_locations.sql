@@ -0,0 +1,15 @@
+CREATE TABLE locations (
+    id          UUID PRIMARY KEY,
+    -- Sorted bytewise, like every other repository
+    name        TEXT COLLATE "C" NOT NULL,
+    category    TEXT NOT NULL,
+    description TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL,
+    updated_at  TIMESTAMPTZ NOT NULL,
+    -- The events stream sequence of the last event applied to the location
+    version     BIGINT NOT NULL
+);
+
+CREATE INDEX locations_created_at ON locations (created_at, id);
+CREATE INDEX locations_name ON locations (name, id);
+CREATE INDEX locations_category_created_at ON locations (category, created_at, id);
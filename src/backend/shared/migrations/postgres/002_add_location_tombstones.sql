@@ -0,0 +1,3 @@
+-- Deleted locations are kept as a tombstone at the version of the delete, so
+-- that replayed events from before it can't bring them back
+ALTER TABLE locations ADD COLUMN deleted BOOLEAN NOT NULL DEFAULT FALSE;
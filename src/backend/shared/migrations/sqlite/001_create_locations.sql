@@ -0,0 +1,15 @@
+CREATE TABLE locations (
+    id          TEXT PRIMARY KEY,
+    name        TEXT NOT NULL,
+    category    TEXT NOT NULL,
+    description TEXT NOT NULL,
+    -- Stored in UTC with a fixed format, so that they sort as text
+    created_at  TIMESTAMP NOT NULL,
+    updated_at  TIMESTAMP NOT NULL,
+    -- The events stream sequence of the last event applied to the location
+    version     INTEGER NOT NULL
+);
+
+CREATE INDEX locations_created_at ON locations (created_at, id);
+CREATE INDEX locations_name ON locations (name, id);
+CREATE INDEX locations_category_created_at ON locations (category, created_at, id);
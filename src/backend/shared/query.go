@@ -0,0 +1,158 @@
+package shared
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//------------------------------------------------------------------------------
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// LocationsSort is the field that locations are listed in order of
+type LocationsSort string
+
+const (
+	SortByCreatedAt LocationsSort = "created_at"
+	SortByName      LocationsSort = "name"
+)
+
+func IsLocationsSort(sort LocationsSort) bool {
+	return sort == SortByCreatedAt || sort == SortByName
+}
+
+// LocationsQuery selects a page of locations. Repositories push as much of it
+// down as they can, and otherwise fall back to Page.
+type LocationsQuery struct {
+	// Category only lists locations of the category, if set
+	Category string
+	// CreatedFrom (inclusive) & CreatedTo (exclusive) bound CreatedAt, if set
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+
+	Sort       LocationsSort
+	Descending bool
+	// Limit is the most locations to list, or all of them if zero
+	Limit int
+	// After continues listing from the previous page's NextCursor
+	After *LocationsCursor
+}
+
+type LocationsPage struct {
+	Locations []Location
+	// NextCursor lists the next page, and is nil on the last one
+	NextCursor *LocationsCursor
+	// Revision is the revision of the read model that the page reflects, if the
+	// repository knows it
+	Revision uint64
+}
+
+// Matches reports whether the location is selected by the filters, and comes
+// after the cursor
+func (q LocationsQuery) Matches(location Location) bool {
+	if q.Category != "" && location.Category != q.Category {
+		return false
+	}
+	if q.CreatedFrom != nil && location.CreatedAt.Before(*q.CreatedFrom) {
+		return false
+	}
+	if q.CreatedTo != nil && !location.CreatedAt.Before(*q.CreatedTo) {
+		return false
+	}
+	if q.After != nil && q.Compare(location, q.After.location()) <= 0 {
+		return false
+	}
+	return true
+}
+
+// Compare orders locations by the sort field, then by id to break ties
+func (q LocationsQuery) Compare(a, b Location) int {
+	var order int
+	switch q.Sort {
+	case SortByName:
+		order = strings.Compare(a.Name, b.Name)
+	default:
+		order = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if order == 0 {
+		order = strings.Compare(a.Id.String(), b.Id.String())
+	}
+
+	if q.Descending {
+		return -order
+	}
+	return order
+}
+
+// Page selects the page from every location, for repositories that can't
+// filter & sort for themselves
+func (q LocationsQuery) Page(locations []Location) *LocationsPage {
+	page := &LocationsPage{Locations: []Location{}}
+	for _, location := range locations {
+		if q.Matches(location) {
+			page.Locations = append(page.Locations, location)
+		}
+	}
+	slices.SortFunc(page.Locations, q.Compare)
+
+	if q.Limit > 0 && len(page.Locations) > q.Limit {
+		page.Locations = page.Locations[:q.Limit]
+		page.NextCursor = q.CursorAfter(page.Locations[q.Limit-1])
+	}
+	return page
+}
+
+// CursorAfter is the cursor to carry on listing after the location
+func (q LocationsQuery) CursorAfter(location Location) *LocationsCursor {
+	cursor := &LocationsCursor{Sort: q.Sort, Descending: q.Descending, Id: location.Id}
+	switch q.Sort {
+	case SortByName:
+		cursor.Name = location.Name
+	default:
+		cursor.CreatedAt = location.CreatedAt
+	}
+	return cursor
+}
+
+//------------------------------------------------------------------------------
+
+// LocationsCursor is the position of the last location of a page, by the
+// sort field & id. It is only valid for a query with the same sort.
+type LocationsCursor struct {
+	Sort       LocationsSort `json:"s"`
+	Descending bool          `json:"d,omitempty"`
+	Name       string        `json:"n,omitempty"`
+	CreatedAt  time.Time     `json:"c"`
+	Id         uuid.UUID     `json:"i"`
+}
+
+func (c *LocationsCursor) location() Location {
+	return Location{Id: c.Id, Name: c.Name, CreatedAt: c.CreatedAt}
+}
+
+// String encodes the cursor opaquely, to be passed back as is
+func (c *LocationsCursor) String() string {
+	bytes, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+func ParseLocationsCursor(raw string) (*LocationsCursor, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidCursor, raw)
+	}
+
+	cursor := &LocationsCursor{}
+	err = json.Unmarshal(bytes, cursor)
+	if err != nil || !IsLocationsSort(cursor.Sort) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidCursor, raw)
+	}
+	return cursor, nil
+}
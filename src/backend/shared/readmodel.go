@@ -0,0 +1,214 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+//------------------------------------------------------------------------------
+
+// LocationsReadModel is the key of the locations read model in the read
+// models bucket
+const LocationsReadModel = "locations"
+
+// ReadModelPointer records which bucket a read model is served from. It is
+// switched over to a new bucket once that has been rebuilt.
+type ReadModelPointer struct {
+	Bucket string `json:"bucket"`
+	// Sequence is the last event the rebuild projected before switching over,
+	// after which the live projector takes over
+	Sequence   uint64    `json:"sequence"`
+	SwitchedAt time.Time `json:"switched_at"`
+}
+
+// GetReadModelPointer looks up the bucket the read model is served from,
+// falling back to the default bucket if it was never rebuilt
+func GetReadModelPointer(ctx context.Context, readModels jetstream.KeyValue, name string, defaultBucket string) (ReadModelPointer, error) {
+	entry, err := readModels.Get(ctx, name)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return ReadModelPointer{Bucket: defaultBucket}, nil
+	}
+	if err != nil {
+		return ReadModelPointer{}, err
+	}
+
+	pointer := ReadModelPointer{}
+	err = json.Unmarshal(entry.Value(), &pointer)
+	return pointer, err
+}
+
+// SwitchReadModel points the read model at another bucket
+func SwitchReadModel(ctx context.Context, readModels jetstream.KeyValue, name string, pointer ReadModelPointer) error {
+	bytes, err := json.Marshal(pointer)
+	if err != nil {
+		return err
+	}
+	_, err = readModels.Put(ctx, name, bytes)
+	return err
+}
+
+//------------------------------------------------------------------------------
+
+// SwitchingLocationsRepository serves the locations read model from whichever
+// bucket is active, switching over as soon as the read model pointer changes.
+// If cached, reads are served from an in-memory copy of the active bucket.
+type SwitchingLocationsRepository struct {
+	js         jetstream.JetStream
+	readModels jetstream.KeyValue
+	cached     bool
+	active     atomic.Pointer[activeLocationsRepository]
+	logger     *slog.Logger
+}
+
+type activeLocationsRepository struct {
+	repo    LocationsRepository
+	cache   *CachedLocationsRepository
+	pointer ReadModelPointer
+}
+
+func NewSwitchingLocationsRepository(
+	ctx context.Context,
+	js jetstream.JetStream,
+	readModels jetstream.KeyValue,
+	defaultBucket string,
+	cached bool,
+	logger *slog.Logger,
+) (*SwitchingLocationsRepository, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	r := &SwitchingLocationsRepository{js: js, readModels: readModels, cached: cached, logger: logger}
+
+	pointer, err := GetReadModelPointer(ctx, readModels, LocationsReadModel, defaultBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get read model pointer: %w", err)
+	}
+	err = r.switchTo(ctx, pointer)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Watch switches over whenever the read model pointer changes, until the
+// context is cancelled
+func (r *SwitchingLocationsRepository) Watch(ctx context.Context) error {
+	// Starts with the current pointer, in case it changed since it was looked up
+	watcher, err := r.readModels.Watch(ctx, LocationsReadModel)
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return nil
+			}
+			if entry == nil || entry.Operation() != jetstream.KeyValuePut {
+				continue
+			}
+
+			pointer := ReadModelPointer{}
+			err := json.Unmarshal(entry.Value(), &pointer)
+			if err != nil {
+				r.logger.Error("Invalid read model pointer", "err", err)
+				continue
+			}
+			if pointer == r.Active() {
+				continue
+			}
+			err = r.switchTo(ctx, pointer)
+			if err != nil {
+				r.logger.Error("Failed to switch read model", "bucket", pointer.Bucket, "err", err)
+			}
+
+		case <-ctx.Done():
+			if cache := r.active.Load().cache; cache != nil {
+				cache.Stop()
+			}
+			return nil
+		}
+	}
+}
+
+func (r *SwitchingLocationsRepository) switchTo(ctx context.Context, pointer ReadModelPointer) error {
+	kv, err := r.js.KeyValue(ctx, pointer.Bucket)
+	if err != nil {
+		return fmt.Errorf("failed to open read model bucket '%s': %w", pointer.Bucket, err)
+	}
+
+	active := &activeLocationsRepository{
+		repo:    NewNatsKvLocationsRepository(kv, r.logger),
+		pointer: pointer,
+	}
+	if r.cached {
+		active.cache = NewCachedLocationsRepository(active.repo, kv, r.logger)
+		err = active.cache.Load(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load read model bucket '%s': %w", pointer.Bucket, err)
+		}
+		active.repo = active.cache
+	}
+
+	previous := r.active.Swap(active)
+	if previous != nil && previous.cache != nil {
+		previous.cache.Stop()
+	}
+	r.logger.Info("Serving read model", "bucket", pointer.Bucket, "sequence", pointer.Sequence, "cached", r.cached)
+	return nil
+}
+
+// Active is the pointer to the bucket currently being served
+func (r *SwitchingLocationsRepository) Active() ReadModelPointer {
+	return r.active.Load().pointer
+}
+
+// Revision is the last revision of the active bucket that reads reflect, or
+// zero if they aren't cached
+func (r *SwitchingLocationsRepository) Revision() uint64 {
+	if cache := r.active.Load().cache; cache != nil {
+		return cache.Revision()
+	}
+	return 0
+}
+
+// Sync waits until reads reflect every write to the active bucket so far
+func (r *SwitchingLocationsRepository) Sync(ctx context.Context) error {
+	if cache := r.active.Load().cache; cache != nil {
+		return cache.Sync(ctx)
+	}
+	return nil
+}
+
+func (r *SwitchingLocationsRepository) GetLocation(ctx context.Context, id uuid.UUID) (*Location, error) {
+	return r.active.Load().repo.GetLocation(ctx, id)
+}
+
+func (r *SwitchingLocationsRepository) CreateLocation(ctx context.Context, location Location) error {
+	return r.active.Load().repo.CreateLocation(ctx, location)
+}
+
+func (r *SwitchingLocationsRepository) UpdateLocation(ctx context.Context, location Location) error {
+	return r.active.Load().repo.UpdateLocation(ctx, location)
+}
+
+func (r *SwitchingLocationsRepository) DeleteLocation(ctx context.Context, id uuid.UUID, version uint64) error {
+	return r.active.Load().repo.DeleteLocation(ctx, id, version)
+}
+
+func (r *SwitchingLocationsRepository) ListLocations(ctx context.Context, query LocationsQuery) (*LocationsPage, error) {
+	return r.active.Load().repo.ListLocations(ctx, query)
+}
+
+// Interface assertion
+var _ LocationsRepository = (*SwitchingLocationsRepository)(nil)
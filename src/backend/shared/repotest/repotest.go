@@ -0,0 +1,332 @@
+// Package repotest checks that a LocationsRepository keeps the contract that
+// every implementation must, so that they can be swapped for one another.
+package repotest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nats_cqrs/shared"
+)
+
+//------------------------------------------------------------------------------
+
+// Run runs every check against the repository, as a subtest each. The checks
+// only look at the locations they created, so the repository can be shared.
+func Run(t *testing.T, repo shared.LocationsRepository) {
+	t.Helper()
+
+	for _, check := range checks {
+		check := check
+		t.Run(check.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			err := check.run(ctx, repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// check is one part of the contract that every LocationsRepository must keep
+type check struct {
+	name string
+	run  func(ctx context.Context, repo shared.LocationsRepository) error
+}
+
+var checks = []check{
+	{"get unknown location is not found", checkGetUnknown},
+	{"created location can be got", checkCreateGet},
+	{"update replaces an earlier version", checkUpdate},
+	{"stale versions are skipped", checkStaleVersion},
+	{"deleted location is not found", checkDelete},
+	{"replayed writes don't bring back a deleted location", checkDeletedStaysDeleted},
+	{"filters by category & created at", checkFilters},
+	{"sorts by created at & name", checkSort},
+	{"pages through every location once", checkPagination},
+}
+
+func checkGetUnknown(ctx context.Context, repo shared.LocationsRepository) error {
+	_, err := repo.GetLocation(ctx, uuid.New())
+	if !errors.Is(err, shared.ErrNotFound) {
+		return fmt.Errorf("expected ErrNotFound, got %v", err)
+	}
+	return nil
+}
+
+func checkCreateGet(ctx context.Context, repo shared.LocationsRepository) error {
+	location := newLocation("Created", "Town", randomEpoch(), 1)
+	err := repo.CreateLocation(ctx, location)
+	if err != nil {
+		return err
+	}
+	return expectLocation(ctx, repo, location)
+}
+
+func checkUpdate(ctx context.Context, repo shared.LocationsRepository) error {
+	location := newLocation("Before", "Town", randomEpoch(), 1)
+	err := repo.CreateLocation(ctx, location)
+	if err != nil {
+		return err
+	}
+
+	location.Name = "After"
+	location.Description = "Updated"
+	location.UpdatedAt = location.CreatedAt.Add(time.Minute)
+	location.Version = 5
+	err = repo.UpdateLocation(ctx, location)
+	if err != nil {
+		return err
+	}
+	return expectLocation(ctx, repo, location)
+}
+
+func checkStaleVersion(ctx context.Context, repo shared.LocationsRepository) error {
+	location := newLocation("Current", "City", randomEpoch(), 7)
+	err := repo.CreateLocation(ctx, location)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range []uint64{3, 7} {
+		stale := location
+		stale.Name = "Stale"
+		stale.Version = version
+		err = repo.UpdateLocation(ctx, stale)
+		if err != nil {
+			return fmt.Errorf("stale version %d: %w", version, err)
+		}
+	}
+	return expectLocation(ctx, repo, location)
+}
+
+func checkDelete(ctx context.Context, repo shared.LocationsRepository) error {
+	location := newLocation("Deleted", "County/Region", randomEpoch(), 1)
+	err := repo.CreateLocation(ctx, location)
+	if err != nil {
+		return err
+	}
+
+	err = repo.DeleteLocation(ctx, location.Id, 2)
+	if err != nil {
+		return err
+	}
+	_, err = repo.GetLocation(ctx, location.Id)
+	if !errors.Is(err, shared.ErrNotFound) {
+		return fmt.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// Deleting it again is a no-op
+	return repo.DeleteLocation(ctx, location.Id, 2)
+}
+
+func checkDeletedStaysDeleted(ctx context.Context, repo shared.LocationsRepository) error {
+	epoch := randomEpoch()
+	location := newLocation("Resurrected", "Country", epoch, 1)
+
+	// As if the live projector deleted it before a rebuild replayed its create
+	// & update
+	err := repo.DeleteLocation(ctx, location.Id, 3)
+	if err != nil {
+		return err
+	}
+	err = repo.CreateLocation(ctx, location)
+	if err != nil {
+		return err
+	}
+	location.Name = "Renamed"
+	location.Version = 2
+	err = repo.UpdateLocation(ctx, location)
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.GetLocation(ctx, location.Id)
+	if !errors.Is(err, shared.ErrNotFound) {
+		return fmt.Errorf("expected ErrNotFound, got %v", err)
+	}
+	from, to := epoch, epoch.Add(time.Minute)
+	page, err := repo.ListLocations(ctx, shared.LocationsQuery{CreatedFrom: &from, CreatedTo: &to, Sort: shared.SortByCreatedAt})
+	if err != nil {
+		return err
+	}
+	return expectLocations(page.Locations, []shared.Location{})
+}
+
+func checkFilters(ctx context.Context, repo shared.LocationsRepository) error {
+	epoch := randomEpoch()
+	locations, err := seedLocations(ctx, repo, epoch, 10)
+	if err != nil {
+		return err
+	}
+
+	from, to := epoch.Add(2*time.Minute), epoch.Add(8*time.Minute)
+	query := shared.LocationsQuery{
+		Category:    "City",
+		CreatedFrom: &from,
+		CreatedTo:   &to,
+		Sort:        shared.SortByCreatedAt,
+	}
+
+	expected := []shared.Location{}
+	for _, location := range locations {
+		if location.Category == "City" && !location.CreatedAt.Before(from) && location.CreatedAt.Before(to) {
+			expected = append(expected, location)
+		}
+	}
+
+	page, err := repo.ListLocations(ctx, query)
+	if err != nil {
+		return err
+	}
+	return expectLocations(page.Locations, expected)
+}
+
+func checkSort(ctx context.Context, repo shared.LocationsRepository) error {
+	epoch := randomEpoch()
+	locations, err := seedLocations(ctx, repo, epoch, 6)
+	if err != nil {
+		return err
+	}
+	from, to := epoch, epoch.Add(time.Hour)
+
+	for _, sort := range []shared.LocationsSort{shared.SortByCreatedAt, shared.SortByName} {
+		for _, descending := range []bool{false, true} {
+			query := shared.LocationsQuery{CreatedFrom: &from, CreatedTo: &to, Sort: sort, Descending: descending}
+
+			page, err := repo.ListLocations(ctx, query)
+			if err != nil {
+				return err
+			}
+			err = expectLocations(page.Locations, query.Page(locations).Locations)
+			if err != nil {
+				return fmt.Errorf("sort %s (descending %v): %w", sort, descending, err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkPagination(ctx context.Context, repo shared.LocationsRepository) error {
+	epoch := randomEpoch()
+	locations, err := seedLocations(ctx, repo, epoch, 11)
+	if err != nil {
+		return err
+	}
+	from, to := epoch, epoch.Add(time.Hour)
+
+	for _, sort := range []shared.LocationsSort{shared.SortByCreatedAt, shared.SortByName} {
+		query := shared.LocationsQuery{CreatedFrom: &from, CreatedTo: &to, Sort: sort, Descending: true, Limit: 4}
+
+		listed := []shared.Location{}
+		for pages := 1; ; pages++ {
+			page, err := repo.ListLocations(ctx, query)
+			if err != nil {
+				return err
+			}
+			if len(page.Locations) > query.Limit {
+				return fmt.Errorf("page %d has %d locations, over the limit of %d", pages, len(page.Locations), query.Limit)
+			}
+			listed = append(listed, page.Locations...)
+
+			if page.NextCursor == nil {
+				break
+			}
+			if pages > len(locations) {
+				return fmt.Errorf("still paging after %d pages", pages)
+			}
+			// As passed back by a client
+			query.After, err = shared.ParseLocationsCursor(page.NextCursor.String())
+			if err != nil {
+				return err
+			}
+		}
+
+		query.Limit, query.After = 0, nil
+		err = expectLocations(listed, query.Page(locations).Locations)
+		if err != nil {
+			return fmt.Errorf("sort %s: %w", sort, err)
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+
+// randomEpoch is a time that no other check creates locations around, so that
+// checks can list their own by filtering on it
+func randomEpoch() time.Time {
+	return time.Date(2000+rand.Intn(1000), time.January, 1, 0, 0, 0, 0, time.UTC).
+		Add(time.Duration(rand.Int63n(int64(365 * 24 * time.Hour)))).
+		Truncate(time.Microsecond)
+}
+
+func newLocation(name string, category string, createdAt time.Time, version uint64) shared.Location {
+	return shared.Location{
+		Id:          uuid.New(),
+		Name:        name,
+		Category:    category,
+		Description: fmt.Sprintf("%s %s", category, name),
+		CreatedAt:   createdAt,
+		UpdatedAt:   createdAt,
+		Version:     version,
+	}
+}
+
+// seedLocations creates locations a minute apart from the epoch, some of them
+// sharing a name so that ties are broken by id
+func seedLocations(ctx context.Context, repo shared.LocationsRepository, epoch time.Time, count int) ([]shared.Location, error) {
+	locations := []shared.Location{}
+	for i := 0; i < count; i++ {
+		location := newLocation(
+			fmt.Sprintf("Location %d", i%(count/2+1)),
+			shared.LocationCategories[i%len(shared.LocationCategories)],
+			epoch.Add(time.Duration(i)*time.Minute),
+			uint64(i+1),
+		)
+		err := repo.CreateLocation(ctx, location)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
+
+func expectLocation(ctx context.Context, repo shared.LocationsRepository, expected shared.Location) error {
+	location, err := repo.GetLocation(ctx, expected.Id)
+	if err != nil {
+		return err
+	}
+	return expectLocations([]shared.Location{*location}, []shared.Location{expected})
+}
+
+func expectLocations(actual []shared.Location, expected []shared.Location) error {
+	if len(actual) != len(expected) {
+		return fmt.Errorf("expected %d locations, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if !sameLocation(actual[i], expected[i]) {
+			return fmt.Errorf("location %d: expected %+v, got %+v", i, expected[i], actual[i])
+		}
+	}
+	return nil
+}
+
+func sameLocation(a, b shared.Location) bool {
+	return a.Id == b.Id &&
+		a.Name == b.Name &&
+		a.Category == b.Category &&
+		a.Description == b.Description &&
+		a.CreatedAt.Equal(b.CreatedAt) &&
+		a.UpdatedAt.Equal(b.UpdatedAt) &&
+		a.Version == b.Version
+}
@@ -0,0 +1,174 @@
+package shared
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+
+var ErrPendingMigrations = errors.New("read model schema is out of date, run `migrate`")
+
+// Every dialect has its own migrations, named `<version>_<description>.sql`
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// SchemaMigration is a change to the schema of a SQL read model, applied in
+// order of version
+type SchemaMigration struct {
+	Version   int
+	Name      string
+	statement string
+}
+
+func (m SchemaMigration) String() string {
+	return fmt.Sprintf("%03d_%s", m.Version, m.Name)
+}
+
+func schemaMigrations(dialect sqlDialect) ([]SchemaMigration, error) {
+	dir := path.Join("migrations", dialect.name)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []SchemaMigration{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".sql")
+		if !ok {
+			continue
+		}
+		rawVersion, description, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(rawVersion)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid migration name '%s'", entry.Name())
+		}
+
+		statement, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, SchemaMigration{Version: version, Name: description, statement: string(statement)})
+	}
+
+	slices.SortFunc(migrations, func(a, b SchemaMigration) int { return a.Version - b.Version })
+	return migrations, nil
+}
+
+// PendingMigrations are the migrations that haven't been applied yet
+func (r *SqlLocationsRepository) PendingMigrations(ctx context.Context) ([]SchemaMigration, error) {
+	migrations, err := schemaMigrations(r.dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	err = r.db.QueryRowContext(ctx, r.dialect.rebind(r.dialect.tableExists), "schema_migrations").Scan(&exists)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	if !exists {
+		return migrations, nil
+	}
+
+	rows, err := r.db.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	defer rows.Close()
+
+	applied := map[int]bool{}
+	for rows.Next() {
+		var version int
+		err = rows.Scan(&version)
+		if err != nil {
+			return nil, sqlError(err)
+		}
+		applied[version] = true
+	}
+	if rows.Err() != nil {
+		return nil, sqlError(rows.Err())
+	}
+
+	pending := []SchemaMigration{}
+	for _, migration := range migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// CheckSchema fails if any migrations are pending, so that nothing runs
+// against an out of date schema
+func (r *SqlLocationsRepository) CheckSchema(ctx context.Context) error {
+	pending, err := r.PendingMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		names := make([]string, len(pending))
+		for i, migration := range pending {
+			names[i] = migration.String()
+		}
+		return fmt.Errorf("%w: %s", ErrPendingMigrations, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// Migrate applies the pending migrations, each in a transaction of its own
+func (r *SqlLocationsRepository) Migrate(ctx context.Context) ([]SchemaMigration, error) {
+	_, err := r.db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			applied_at TEXT NOT NULL
+		)`)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	pending, err := r.PendingMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, migration := range pending {
+		err = r.applyMigration(ctx, migration)
+		if err != nil {
+			return pending[:i], fmt.Errorf("failed to apply migration %s: %w", migration, err)
+		}
+		r.logger.Info("Applied migration", "migration", migration.String())
+	}
+	return pending, nil
+}
+
+func (r *SqlLocationsRepository) applyMigration(ctx context.Context, migration SchemaMigration) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlError(err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, migration.statement)
+	if err != nil {
+		return sqlError(err)
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		r.dialect.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"),
+		migration.Version,
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return sqlError(err)
+	}
+	return sqlError(tx.Commit())
+}
@@ -2,40 +2,49 @@ package shared
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 )
 
 //------------------------------------------------------------------------------
 
 const (
-	StreamName                        = "all"
 	StreamSubjectNotifications        = "notifications"
 	StreamSubjectCommands             = "commands"
 	NotificationAwaitHeader           = "X-Notification-Await"
 	NotificationTimeoutHeader         = "X-Notification-Timeout"
 	NotificationSimulateTimeoutHeader = "X-Notification-Simulate-Timeout"
+	SessionIdHeader                   = "X-Session-Id"
+	CommandHeader                     = "X-Command"
+	CommandIdHeader                   = "X-Command-Id"
+	IdempotencyKeyHeader              = "Idempotency-Key"
+	IdempotencyReplayedHeader         = "Idempotent-Replayed"
+	// SessionTokenHeader is sent with commands by clients that were issued a
+	// session, whose (verified) id is then carried on NATS by SessionIdHeader
+	SessionTokenHeader = "X-Session-Token"
+	// ConsistencyTokenHeader is returned when a command is accepted, and can be
+	// sent with a query to read what the command wrote
+	ConsistencyTokenHeader = "X-Consistency-Token"
+	// NextCursorHeader is returned with a page of locations, if there is another
+	NextCursorHeader = "X-Next-Cursor"
+	// ReadModelRevisionHeader is the revision of the read model that a query
+	// reflects, when it is served from the cache
+	ReadModelRevisionHeader = "X-Read-Model-Revision"
 )
 
 //------------------------------------------------------------------------------
 
-func GetEnv(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if len(value) == 0 {
-		return defaultValue
-	}
-	return value
-}
-
-//------------------------------------------------------------------------------
-
 type CreateLocationCommand struct {
 	Id          uuid.UUID `json:"id"`
 	Name        string    `json:"name"`
@@ -44,21 +53,124 @@ type CreateLocationCommand struct {
 	CreatedAt   time.Time `json:"created_at"`
 }
 
+func (c CreateLocationCommand) CommandName() string    { return "CreateLocation" }
+func (c CreateLocationCommand) CommandId() uuid.UUID   { return c.Id }
+func (c CreateLocationCommand) AggregateId() uuid.UUID { return c.Id }
+
+// UpdateLocationCommand changes the given fields of a location, leaving any
+// that are nil untouched
+type UpdateLocationCommand struct {
+	Id          uuid.UUID `json:"id"`
+	LocationId  uuid.UUID `json:"location_id"`
+	Name        *string   `json:"name,omitempty"`
+	Category    *string   `json:"category,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// ExpectedVersion rejects the command if the location has changed since
+	ExpectedVersion *uint64 `json:"expected_version,omitempty"`
+}
+
+func (c UpdateLocationCommand) CommandName() string    { return "UpdateLocation" }
+func (c UpdateLocationCommand) CommandId() uuid.UUID   { return c.Id }
+func (c UpdateLocationCommand) AggregateId() uuid.UUID { return c.LocationId }
+
+type DeleteLocationCommand struct {
+	Id         uuid.UUID `json:"id"`
+	LocationId uuid.UUID `json:"location_id"`
+	DeletedAt  time.Time `json:"deleted_at"`
+	// ExpectedVersion rejects the command if the location has changed since
+	ExpectedVersion *uint64 `json:"expected_version,omitempty"`
+}
+
+func (c DeleteLocationCommand) CommandName() string    { return "DeleteLocation" }
+func (c DeleteLocationCommand) CommandId() uuid.UUID   { return c.Id }
+func (c DeleteLocationCommand) AggregateId() uuid.UUID { return c.LocationId }
+
+//------------------------------------------------------------------------------
+
+// ValidationError maps each invalid field to a description of the problem
+type ValidationError map[string]string
+
+func (e ValidationError) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+
+	messages := make([]string, 0, len(fields))
+	for _, field := range fields {
+		messages = append(messages, fmt.Sprintf("%s: %s", field, e[field]))
+	}
+	return fmt.Sprintf("validation failed (%s)", strings.Join(messages, ", "))
+}
+
 //------------------------------------------------------------------------------
 
+// NotificationSubject is the pub-sub subject that notifications for the given
+// command are published on: `notifications.<session>.<command id>`, so that
+// both a command's & a session's notifications can be filtered on by subject
+func NotificationSubject(sessionId string, commandId uuid.UUID) string {
+	return fmt.Sprintf("%s.%s.%s", StreamSubjectNotifications, sessionToken(sessionId), commandId.String())
+}
+
+// CommandNotificationsSubject matches the notifications for the command,
+// whichever session it was submitted with
+func CommandNotificationsSubject(commandId uuid.UUID) string {
+	return fmt.Sprintf("%s.*.%s", StreamSubjectNotifications, commandId.String())
+}
+
+// SessionNotificationsSubject matches the notifications for every command
+// submitted with the session
+func SessionNotificationsSubject(sessionId string) string {
+	return fmt.Sprintf("%s.%s.*", StreamSubjectNotifications, sessionToken(sessionId))
+}
+
+// sessionToken encodes the session id as a single subject token, as it may
+// contain characters (ie. `.` or `*`) that aren't allowed in one. Commands
+// without a session use `_`, which no encoded session id can be.
+func sessionToken(sessionId string) string {
+	if sessionId == "" {
+		return "_"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(sessionId))
+}
+
 type Notification struct {
-	Id      uuid.UUID      `json:"id"`
-	Time    time.Time      `json:"created_at"`
-	Errors  []string       `json:"errors"`
-	Actions []Action       `json:"actions"`
-	Data    map[string]any `json:"data"`
+	Id            uuid.UUID           `json:"id"`
+	CorrelationId uuid.UUID           `json:"correlation_id"`
+	SessionId     string              `json:"session_id,omitempty"`
+	Time          time.Time           `json:"created_at"`
+	Errors        []NotificationError `json:"errors"`
+	Actions       []Action            `json:"actions"`
+	Data          map[string]any      `json:"data"`
+}
+
+// WithCorrelationId links the notification to the command that triggered it
+func (n *Notification) WithCorrelationId(id uuid.UUID) *Notification {
+	n.CorrelationId = id
+	return n
+}
+
+// WithSessionId routes the notification to the session that submitted the
+// command, in addition to the command itself
+func (n *Notification) WithSessionId(id string) *Notification {
+	n.SessionId = id
+	return n
 }
 
-func (n *Notification) WithError(error string) *Notification {
-	n.Errors = append(n.Errors, error)
+func (n *Notification) WithError(code string, message string) *Notification {
+	n.Errors = append(n.Errors, NotificationError{Code: code, Message: message})
 	return n
 }
 
+// WithFailure records the error that the command failed with, under its code.
+// The message is only a description fit for the user - the error itself is
+// left to be logged.
+func (n *Notification) WithFailure(err error) *Notification {
+	return n.WithError(ErrorCode(err), FailureMessage(err))
+}
+
 func (n *Notification) WithAction(action Action) *Notification {
 	n.Actions = append(n.Actions, action)
 	return n
@@ -69,21 +181,95 @@ func (n *Notification) WithData(key string, value any) *Notification {
 	return n
 }
 
+// Failed reports whether the command that the notification is for failed
+func (n *Notification) Failed() bool {
+	return len(n.Errors) > 0
+}
+
 func NewNotification() *Notification {
 	return &Notification{
 		Id:      uuid.New(),
 		Time:    time.Now(),
-		Errors:  []string{},
+		Errors:  []NotificationError{},
 		Actions: []Action{},
 		Data:    map[string]any{},
 	}
 }
 
+// Actions that the client can perform upon receiving a notification
+const (
+	ActionRedirect    = "redirect"
+	ActionRetry       = "retry"
+	ActionShowMessage = "show-message"
+)
+
 type Action struct {
 	Type string `json:"type"`
 	Data any    `json:"data"`
 }
 
+// NotificationError is why a command failed, with a code that clients can
+// act upon
+type NotificationError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	ErrorCodeLocationExists        = "location_exists"
+	ErrorCodeLocationDoesNotExist  = "location_does_not_exist"
+	ErrorCodeDuplicateLocationName = "duplicate_location_name"
+	ErrorCodeVersionConflict       = "version_conflict"
+	ErrorCodeCommandRejected       = "command_rejected"
+	ErrorCodeUnprocessableCommand  = "unprocessable_command"
+	ErrorCodeCommandFailed         = "command_failed"
+)
+
+// ErrorCode maps the error that a command failed with to its NotificationError
+// code
+func ErrorCode(err error) string {
+	var versionConflict VersionConflictError
+	switch {
+	case errors.Is(err, ErrLocationExists):
+		return ErrorCodeLocationExists
+	case errors.Is(err, ErrLocationDoesNotExist):
+		return ErrorCodeLocationDoesNotExist
+	case errors.Is(err, ErrDuplicateLocationName):
+		return ErrorCodeDuplicateLocationName
+	case errors.As(err, &versionConflict):
+		return ErrorCodeVersionConflict
+	case errors.Is(err, ErrCommandRejected):
+		return ErrorCodeCommandRejected
+	case errors.Is(err, ErrMalformedMessage),
+		errors.Is(err, ErrUnknownCommand),
+		errors.Is(err, ErrNoCommandHandler),
+		errors.Is(err, ErrUnknownEvent):
+		return ErrorCodeUnprocessableCommand
+	default:
+		return ErrorCodeCommandFailed
+	}
+}
+
+// FailureMessage describes the error that a command failed with to the user,
+// so does not give away any internals (ie. the raw error)
+func FailureMessage(cause error) string {
+	var versionConflict VersionConflictError
+	switch {
+	case errors.Is(cause, ErrLocationExists):
+		return "This location already exists"
+	case errors.Is(cause, ErrLocationDoesNotExist):
+		return "This location no longer exists"
+	case errors.Is(cause, ErrDuplicateLocationName):
+		return "Another location already has this name"
+	case errors.As(cause, &versionConflict):
+		return "This location was changed by someone else - refresh it and try again"
+	case errors.Is(cause, ErrCommandRejected):
+		return "Your request was rejected"
+	default:
+		return "Something went wrong while processing your request - please try again"
+	}
+}
+
 //------------------------------------------------------------------------------
 
 type Location struct {
@@ -92,28 +278,68 @@ type Location struct {
 	Category    string    `json:"category"`
 	Description string    `json:"description"`
 	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Version is the stream sequence of the last event applied to the location
+	Version uint64 `json:"version"`
 }
 
-func NewLocationFromCommand(command CreateLocationCommand) Location {
-	return Location{
-		Id:          command.Id,
-		Name:        command.Name,
-		Category:    command.Category,
-		Description: command.Description,
-		CreatedAt:   command.CreatedAt,
+// Apply updates the location with the changes described by the event
+func (l *Location) Apply(event Event) {
+	switch e := event.(type) {
+	case LocationCreated:
+		l.Id = e.Id
+		l.Name = e.Name
+		l.Category = e.Category
+		l.Description = e.Description
+		l.CreatedAt = e.OccurredAt
+		l.UpdatedAt = e.OccurredAt
+	case LocationRenamed:
+		l.Name = e.Name
+		l.UpdatedAt = e.OccurredAt
+	case LocationRecategorised:
+		l.Category = e.Category
+		l.UpdatedAt = e.OccurredAt
+	case LocationDescriptionChanged:
+		l.Description = e.Description
+		l.UpdatedAt = e.OccurredAt
 	}
 }
 
+const (
+	LocationNameMaxLength        = 100
+	LocationDescriptionMaxLength = 1000
+)
+
+// LocationCategories are the categories a Location can be assigned
+var LocationCategories = []string{"Town", "City", "County/Region", "Country", "Continent"}
+
+func IsLocationCategory(category string) bool {
+	return slices.Contains(LocationCategories, category)
+}
+
 type LocationsRepository interface {
 	GetLocation(ctx context.Context, id uuid.UUID) (*Location, error)
 	CreateLocation(ctx context.Context, location Location) error
-	ListLocations(ctx context.Context) ([]Location, error)
+	UpdateLocation(ctx context.Context, location Location) error
+	// DeleteLocation leaves a tombstone at the version of the delete, so that
+	// creates & updates replayed from before it can't bring the location back
+	DeleteLocation(ctx context.Context, id uuid.UUID, version uint64) error
+	ListLocations(ctx context.Context, query LocationsQuery) (*LocationsPage, error)
 }
 
+// Errors that every LocationsRepository maps its own errors to, so that callers
+// needn't know which implementation they are using
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("conflict")
+	ErrUnavailable = errors.New("unavailable")
+)
+
 // NatsKvLocationsRepository is a LocationsRepository built upon NATS KV
 //
 // ...You wouldn't do this in prod, but it's an excuse to (ab)use the KV
-// API and reduce dependencies for this demo project!
+// API and reduce dependencies for this demo project! See
+// SqlLocationsRepository for that.
 type NatsKvLocationsRepository struct {
 	kv     jetstream.KeyValue
 	logger *slog.Logger
@@ -127,127 +353,184 @@ func NewNatsKvLocationsRepository(kv jetstream.KeyValue, logger *slog.Logger) *N
 }
 
 func (r *NatsKvLocationsRepository) CreateLocation(ctx context.Context, location Location) error {
+	return r.putLocation(ctx, kvLocation{Location: location})
+}
+
+func (r *NatsKvLocationsRepository) UpdateLocation(ctx context.Context, location Location) error {
+	return r.putLocation(ctx, kvLocation{Location: location})
+}
+
+// kvLocation is a location as stored in KV. Deleted locations are kept as a
+// tombstone of their id & version, which is never read back as a location.
+type kvLocation struct {
+	Location
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func decodeKvLocation(entry jetstream.KeyValueEntry) (kvLocation, error) {
+	stored := kvLocation{}
+	err := json.Unmarshal(entry.Value(), &stored)
+	if err != nil {
+		return stored, fmt.Errorf("invalid Location '%s': %w", entry.Key(), err)
+	}
+	return stored, nil
+}
+
+// putLocation stores the location, unless a later version of it (or of its
+// tombstone) is already stored - so that projecting the same events twice (ie.
+// when rebuilding the read model alongside the live projector) never goes
+// backwards
+func (r *NatsKvLocationsRepository) putLocation(ctx context.Context, location kvLocation) error {
 	bytes, err := json.Marshal(location)
 	if err != nil {
 		return err
 	}
-	_, err = r.kv.Put(ctx, location.Id.String(), bytes)
-	return err
+
+	for {
+		entry, err := r.kv.Get(ctx, location.Id.String())
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			_, err = r.kv.Create(ctx, location.Id.String(), bytes)
+		} else if err == nil {
+			var stored kvLocation
+			stored, err = decodeKvLocation(entry)
+			if err != nil {
+				return err
+			}
+			if stored.Version >= location.Version {
+				r.logger.Debug("Skipping stale Location", "id", location.Id, "version", location.Version, "stored_version", stored.Version)
+				return nil
+			}
+			_, err = r.kv.Update(ctx, location.Id.String(), bytes, entry.Revision())
+		}
+
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			// Written concurrently, so check the version again
+			continue
+		}
+		return kvError(err)
+	}
 }
 
-func (r *NatsKvLocationsRepository) ListLocations(ctx context.Context) ([]Location, error) {
-	var (
-		keys      = []string{}
-		locations = []Location{}
-	)
+func (r *NatsKvLocationsRepository) DeleteLocation(ctx context.Context, id uuid.UUID, version uint64) error {
+	return r.putLocation(ctx, kvLocation{Location: Location{Id: id, Version: version}, Deleted: true})
+}
 
-	keyLister, err := r.kv.ListKeys(ctx)
+// ListLocations reads every location in one go, keeping those that match. KV
+// can't filter or sort by value, so that is all that can be pushed down.
+func (r *NatsKvLocationsRepository) ListLocations(ctx context.Context, query LocationsQuery) (*LocationsPage, error) {
+	watcher, err := r.kv.WatchAll(ctx)
 	if err != nil {
-		return locations, nil
+		return nil, kvError(err)
 	}
+	defer watcher.Stop()
 
-loopKeys:
+	locations := []Location{}
 	for {
 		select {
-		case key, ok := <-keyLister.Keys():
+		case entry, ok := <-watcher.Updates():
 			if !ok {
-				break loopKeys
+				return nil, fmt.Errorf("%w: watcher stopped", ErrUnavailable)
+			}
+			if entry == nil {
+				// Every current value has been received
+				r.logger.Debug(fmt.Sprintf("Got %v matching Locations", len(locations)))
+				return query.Page(locations), nil
+			}
+			if entry.Operation() != jetstream.KeyValuePut {
+				continue
 			}
-			keys = append(keys, key)
-
-		case <-time.After(time.Second):
-			return locations, fmt.Errorf("did not completed in time")
-		}
-	}
 
-	r.logger.Debug(fmt.Sprintf("Got %v keys - Looking up values", len(keys)))
+			stored, err := decodeKvLocation(entry)
+			if err != nil {
+				return nil, err
+			}
+			if !stored.Deleted && query.Matches(stored.Location) {
+				locations = append(locations, stored.Location)
+			}
 
-	for _, key := range keys {
-		id, err := uuid.Parse(key)
-		if err != nil {
-			return locations, err
-		}
-		location, err := r.GetLocation(ctx, id)
-		if err != nil {
-			return locations, err
+		case <-ctx.Done():
+			return nil, kvError(ctx.Err())
 		}
-
-		locations = append(locations, *location)
 	}
-
-	// Sort descending
-	slices.SortFunc(locations, func(a, b Location) int {
-		if a.CreatedAt.Before(b.CreatedAt) {
-			return 1
-		} else {
-			return -1
-		}
-	})
-	return locations, nil
 }
 
 func (r *NatsKvLocationsRepository) GetLocation(ctx context.Context, id uuid.UUID) (*Location, error) {
 	kvEntry, err := r.kv.Get(ctx, id.String())
 	if err != nil {
-		r.logger.Error("Failed to retrieve all Locations")
-		return nil, err
+		return nil, kvError(err)
 	}
 
-	location := &Location{}
-	err = json.Unmarshal(kvEntry.Value(), location)
+	stored, err := decodeKvLocation(kvEntry)
 	if err != nil {
 		return nil, err
 	}
-
-	return location, nil
+	if stored.Deleted {
+		return nil, fmt.Errorf("%w: location %s was deleted", ErrNotFound, id)
+	}
+	return &stored.Location, nil
 }
 
 // Interface assertion
 var _ LocationsRepository = (*NatsKvLocationsRepository)(nil)
 
+// kvError maps a KV error to the repository error it amounts to, keeping the
+// original so that it is still logged
+func kvError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, jetstream.ErrKeyNotFound):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case errors.Is(err, jetstream.ErrKeyExists):
+		return fmt.Errorf("%w: %w", ErrConflict, err)
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, nats.ErrTimeout),
+		errors.Is(err, nats.ErrNoResponders),
+		errors.Is(err, nats.ErrConnectionClosed),
+		errors.Is(err, nats.ErrConnectionDraining),
+		errors.Is(err, nats.ErrDisconnected),
+		errors.Is(err, jetstream.ErrBucketNotFound):
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	default:
+		return err
+	}
+}
+
 //------------------------------------------------------------------------------
 
 func AssertOk(err error, logger *slog.Logger, msg string) {
 	if err != nil {
 		logger.Error(msg, "err", err)
-		os.Exit(0)
+		os.Exit(1)
 	}
 }
 
-func InitialiseKv(js jetstream.JetStream) (jetstream.KeyValue, error) {
-	kvCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
-
-	kv, err := js.CreateKeyValue(kvCtx, jetstream.KeyValueConfig{
-		Bucket:  "locations",
-		History: 20,
-	})
-	return kv, err
-}
-
-func InitialiseStreams(js jetstream.JetStream, logger *slog.Logger) error {
-	stream, err := js.CreateOrUpdateStream(
-		context.Background(),
-		jetstream.StreamConfig{
-			Name: "all",
-			Subjects: []string{
-				fmt.Sprintf("%s.>", StreamSubjectCommands),
-			},
-		})
+// Drain lets in-flight messages & acks on the connection finish, then closes
+// it - giving up once the context is done
+func Drain(ctx context.Context, nc *nats.Conn) error {
+	err := nc.Drain()
 	if err != nil {
 		return err
 	}
 
-	streamInfo, err := stream.Info(context.Background())
-	if err != nil {
-		return err
-	}
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
 
-	logger.Debug(
-		fmt.Sprintf("Setup stream '%s'", streamInfo.Config.Name),
-		"stream", streamInfo.Config.Name,
-		"subjects", streamInfo.Config.Subjects,
-	)
+	for !nc.IsClosed() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			nc.Close()
+			return ctx.Err()
+		}
+	}
 	return nil
+}
+
+// OpenKv opens a KV bucket, which is created beforehand by `migrate`
+func OpenKv(js jetstream.JetStream, bucket string, timeout time.Duration) (jetstream.KeyValue, error) {
+	kvCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
+	return js.KeyValue(kvCtx, bucket)
 }
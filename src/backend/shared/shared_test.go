@@ -0,0 +1,83 @@
+package shared_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/natstest"
+	"nats_cqrs/shared"
+	"nats_cqrs/shared/repotest"
+)
+
+//------------------------------------------------------------------------------
+
+func TestNatsKvLocationsRepository(t *testing.T) {
+	s := natstest.RunServer(t)
+	_, js := natstest.Connect(t, s)
+
+	kv, err := js.CreateKeyValue(context.Background(), jetstream.KeyValueConfig{Bucket: "locations", Storage: jetstream.MemoryStorage})
+	if err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+
+	repotest.Run(t, shared.NewNatsKvLocationsRepository(kv, quietLogger()))
+}
+
+// The cache is checked once loaded, while the bucket it wraps is written to
+func TestCachedLocationsRepository(t *testing.T) {
+	s := natstest.RunServer(t)
+	_, js := natstest.Connect(t, s)
+
+	kv, err := js.CreateKeyValue(context.Background(), jetstream.KeyValueConfig{Bucket: "locations", Storage: jetstream.MemoryStorage})
+	if err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+
+	cache := shared.NewCachedLocationsRepository(shared.NewNatsKvLocationsRepository(kv, quietLogger()), kv, quietLogger())
+	err = cache.Load(context.Background())
+	if err != nil {
+		t.Fatalf("failed to load cache: %v", err)
+	}
+	defer cache.Stop()
+
+	repotest.Run(t, syncedCache{cache})
+}
+
+// syncedCache waits for every write to reach the cache before returning, as
+// the server does before serving a read that must reflect a write
+type syncedCache struct {
+	*shared.CachedLocationsRepository
+}
+
+func (c syncedCache) CreateLocation(ctx context.Context, location shared.Location) error {
+	return c.sync(ctx, c.CachedLocationsRepository.CreateLocation(ctx, location))
+}
+
+func (c syncedCache) UpdateLocation(ctx context.Context, location shared.Location) error {
+	return c.sync(ctx, c.CachedLocationsRepository.UpdateLocation(ctx, location))
+}
+
+func (c syncedCache) DeleteLocation(ctx context.Context, id uuid.UUID, version uint64) error {
+	return c.sync(ctx, c.CachedLocationsRepository.DeleteLocation(ctx, id, version))
+}
+
+func (c syncedCache) sync(ctx context.Context, err error) error {
+	if err != nil {
+		return err
+	}
+	if c.Revision() == 0 {
+		return fmt.Errorf("expected reads to be served from the cache")
+	}
+	return c.Sync(ctx)
+}
+
+// quietLogger discards the repositories' logs, which are per operation
+func quietLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
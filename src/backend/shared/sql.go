@@ -0,0 +1,363 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"nats_cqrs/config"
+)
+
+//------------------------------------------------------------------------------
+
+// SqlLocationsRepository is a LocationsRepository built upon a relational
+// database - SQLite (pure Go, for local testing) or Postgres.
+//
+// Locations are upserted by id, only ever replacing an earlier version of
+// them. Deleted locations are kept as tombstones, which every query skips.
+// Times are stored to the microsecond.
+type SqlLocationsRepository struct {
+	db      *sql.DB
+	dialect sqlDialect
+	logger  *slog.Logger
+}
+
+// OpenSqlLocationsRepository connects to the read model's database. Its schema
+// is migrated separately, by `migrate`.
+func OpenSqlLocationsRepository(ctx context.Context, cfg config.ReadModelConfig, logger *slog.Logger) (*SqlLocationsRepository, error) {
+	dialect, ok := sqlDialects[cfg.Store]
+	if !ok {
+		return nil, fmt.Errorf("unknown SQL read model store '%s'", cfg.Store)
+	}
+
+	db, err := sql.Open(dialect.driver, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, sqlError(err)
+	}
+
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &SqlLocationsRepository{db: db, dialect: dialect, logger: logger}, nil
+}
+
+func (r *SqlLocationsRepository) Close() error {
+	return r.db.Close()
+}
+
+const locationColumns = "id, name, category, description, created_at, updated_at, version"
+
+func (r *SqlLocationsRepository) GetLocation(ctx context.Context, id uuid.UUID) (*Location, error) {
+	row := r.db.QueryRowContext(
+		ctx,
+		r.dialect.rebind("SELECT "+locationColumns+" FROM locations WHERE id = ? AND NOT deleted"),
+		id,
+	)
+
+	location, err := r.scanLocation(row)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	return location, nil
+}
+
+func (r *SqlLocationsRepository) CreateLocation(ctx context.Context, location Location) error {
+	return r.upsertLocation(ctx, location, false)
+}
+
+func (r *SqlLocationsRepository) UpdateLocation(ctx context.Context, location Location) error {
+	return r.upsertLocation(ctx, location, false)
+}
+
+func (r *SqlLocationsRepository) DeleteLocation(ctx context.Context, id uuid.UUID, version uint64) error {
+	return r.upsertLocation(ctx, Location{Id: id, Version: version}, true)
+}
+
+// upsertLocation stores the location (or its tombstone), unless a later version
+// of it is already stored - so that projecting the same events twice never goes
+// backwards
+func (r *SqlLocationsRepository) upsertLocation(ctx context.Context, location Location, deleted bool) error {
+	result, err := r.db.ExecContext(
+		ctx,
+		r.dialect.rebind(`
+			INSERT INTO locations (`+locationColumns+`, deleted)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				name = excluded.name,
+				category = excluded.category,
+				description = excluded.description,
+				created_at = excluded.created_at,
+				updated_at = excluded.updated_at,
+				version = excluded.version,
+				deleted = excluded.deleted
+			WHERE locations.version < excluded.version`),
+		location.Id,
+		location.Name,
+		location.Category,
+		location.Description,
+		r.dialect.timeValue(location.CreatedAt),
+		r.dialect.timeValue(location.UpdatedAt),
+		location.Version,
+		deleted,
+	)
+	if err != nil {
+		return sqlError(err)
+	}
+
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		r.logger.Debug("Skipping stale Location", "id", location.Id, "version", location.Version)
+	}
+	return nil
+}
+
+// ListLocations pushes the whole query down into SQL, fetching one more
+// location than the limit to tell whether there is another page
+func (r *SqlLocationsRepository) ListLocations(ctx context.Context, query LocationsQuery) (*LocationsPage, error) {
+	var (
+		conditions = []string{"NOT deleted"}
+		args       = []any{}
+		column     = "created_at"
+		direction  = "ASC"
+		comparison = ">"
+	)
+
+	if query.Sort == SortByName {
+		column = "name"
+	}
+	if query.Descending {
+		direction = "DESC"
+		comparison = "<"
+	}
+
+	if query.Category != "" {
+		conditions = append(conditions, "category = ?")
+		args = append(args, query.Category)
+	}
+	if query.CreatedFrom != nil {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, r.dialect.timeValue(*query.CreatedFrom))
+	}
+	if query.CreatedTo != nil {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, r.dialect.timeValue(*query.CreatedTo))
+	}
+	if query.After != nil {
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s (?, ?)", column, comparison))
+		if query.Sort == SortByName {
+			args = append(args, query.After.Name)
+		} else {
+			args = append(args, r.dialect.timeValue(query.After.CreatedAt))
+		}
+		args = append(args, query.After.Id)
+	}
+
+	statement := "SELECT " + locationColumns + " FROM locations WHERE " + strings.Join(conditions, " AND ")
+	statement += fmt.Sprintf(" ORDER BY %s %s, id %s", column, direction, direction)
+	if query.Limit > 0 {
+		statement += " LIMIT " + strconv.Itoa(query.Limit+1)
+	}
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(statement), args...)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+	defer rows.Close()
+
+	page := &LocationsPage{Locations: []Location{}}
+	for rows.Next() {
+		location, err := r.scanLocation(rows)
+		if err != nil {
+			return nil, sqlError(err)
+		}
+		page.Locations = append(page.Locations, *location)
+	}
+	if rows.Err() != nil {
+		return nil, sqlError(rows.Err())
+	}
+
+	if query.Limit > 0 && len(page.Locations) > query.Limit {
+		page.Locations = page.Locations[:query.Limit]
+		page.NextCursor = query.CursorAfter(page.Locations[query.Limit-1])
+	}
+	return page, nil
+}
+
+func (r *SqlLocationsRepository) scanLocation(row interface{ Scan(dest ...any) error }) (*Location, error) {
+	var (
+		location             = &Location{}
+		createdAt, updatedAt sqlTime
+	)
+
+	err := row.Scan(
+		&location.Id,
+		&location.Name,
+		&location.Category,
+		&location.Description,
+		&createdAt,
+		&updatedAt,
+		&location.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	location.CreatedAt = time.Time(createdAt)
+	location.UpdatedAt = time.Time(updatedAt)
+	return location, nil
+}
+
+// Interface assertion
+var _ LocationsRepository = (*SqlLocationsRepository)(nil)
+
+// sqlError maps a database error to the repository error it amounts to,
+// keeping the original so that it is still logged
+func sqlError(err error) error {
+	var (
+		pgErr      *pgconn.PgError
+		connectErr *pgconn.ConnectError
+		sqliteErr  *sqlite.Error
+		netErr     net.Error
+	)
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case errors.As(err, &pgErr):
+		switch {
+		// Unique violation & serialization failure
+		case pgErr.Code == "23505", pgErr.Code == "40001":
+			return fmt.Errorf("%w: %w", ErrConflict, err)
+		// Connection exceptions, insufficient resources & operator intervention
+		case strings.HasPrefix(pgErr.Code, "08"),
+			strings.HasPrefix(pgErr.Code, "53"),
+			strings.HasPrefix(pgErr.Code, "57"):
+			return fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+		return err
+	case errors.As(err, &sqliteErr):
+		switch sqliteErr.Code() & 0xff {
+		case sqlite3.SQLITE_CONSTRAINT:
+			return fmt.Errorf("%w: %w", ErrConflict, err)
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+			return fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+		return err
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, sql.ErrConnDone),
+		errors.As(err, &connectErr),
+		errors.As(err, &netErr):
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	default:
+		return err
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// sqlDialect is what differs between the supported databases
+type sqlDialect struct {
+	name   string
+	driver string
+	// numbered placeholders (ie. `$1`) instead of `?`
+	numbered bool
+	// textTimes stores times as text, formatted so that they sort
+	textTimes bool
+	// tableExists is a query for whether the table (its one argument) exists
+	tableExists string
+}
+
+var sqlDialects = map[string]sqlDialect{
+	config.ReadModelStoreSqlite: {
+		name:        config.ReadModelStoreSqlite,
+		driver:      "sqlite",
+		textTimes:   true,
+		tableExists: "SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = ?",
+	},
+	config.ReadModelStorePostgres: {
+		name:        config.ReadModelStorePostgres,
+		driver:      "pgx",
+		numbered:    true,
+		tableExists: "SELECT to_regclass(?) IS NOT NULL",
+	},
+}
+
+// sqlTimeFormat is fixed width & in UTC, so that SQLite sorts it as text
+const sqlTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// rebind rewrites the `?` placeholders of the statement for the dialect
+func (d sqlDialect) rebind(statement string) string {
+	if !d.numbered {
+		return statement
+	}
+
+	var (
+		rebound strings.Builder
+		n       = 0
+	)
+	for _, char := range statement {
+		if char == '?' {
+			n++
+			rebound.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		rebound.WriteRune(char)
+	}
+	return rebound.String()
+}
+
+func (d sqlDialect) timeValue(t time.Time) any {
+	t = t.UTC().Truncate(time.Microsecond)
+	if d.textTimes {
+		return t.Format(sqlTimeFormat)
+	}
+	return t
+}
+
+// sqlTime scans a time whether the driver returns it as a time or as text
+type sqlTime time.Time
+
+func (t *sqlTime) Scan(value any) error {
+	switch v := value.(type) {
+	case time.Time:
+		*t = sqlTime(v.UTC())
+	case string:
+		return t.parse(v)
+	case []byte:
+		return t.parse(string(v))
+	default:
+		return fmt.Errorf("cannot scan %T into a time", value)
+	}
+	return nil
+}
+
+func (t *sqlTime) parse(value string) error {
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return err
+	}
+	*t = sqlTime(parsed.UTC())
+	return nil
+}
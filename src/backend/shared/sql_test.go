@@ -0,0 +1,56 @@
+package shared_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"nats_cqrs/config"
+	"nats_cqrs/shared"
+	"nats_cqrs/shared/repotest"
+)
+
+//------------------------------------------------------------------------------
+
+func TestSqliteLocationsRepository(t *testing.T) {
+	repotest.Run(t, openSqlRepository(t, config.ReadModelConfig{
+		Store:        config.ReadModelStoreSqlite,
+		DSN:          fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)", filepath.Join(t.TempDir(), "locations.db")),
+		MaxOpenConns: 10,
+	}))
+}
+
+// Only runs against a scratch database given by CONTRACT_POSTGRES_DSN, as the
+// locations it creates are left behind
+func TestPostgresLocationsRepository(t *testing.T) {
+	dsn := os.Getenv("CONTRACT_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("CONTRACT_POSTGRES_DSN isn't set")
+	}
+
+	repotest.Run(t, openSqlRepository(t, config.ReadModelConfig{
+		Store:        config.ReadModelStorePostgres,
+		DSN:          dsn,
+		MaxOpenConns: 10,
+	}))
+}
+
+// openSqlRepository opens the database & migrates its schema
+func openSqlRepository(t *testing.T, cfg config.ReadModelConfig) *shared.SqlLocationsRepository {
+	t.Helper()
+
+	ctx := context.Background()
+	repo, err := shared.OpenSqlLocationsRepository(ctx, cfg, quietLogger())
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { _ = repo.Close() })
+
+	_, err = repo.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	return repo
+}
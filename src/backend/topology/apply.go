@@ -0,0 +1,77 @@
+package topology
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+//------------------------------------------------------------------------------
+
+var (
+	ErrDestructiveChanges = errors.New("refusing to apply destructive changes without forcing")
+	ErrPendingChanges     = errors.New("topology is out of date, run `migrate`")
+)
+
+// Apply makes the planned changes, one at a time & in order. Unless forced,
+// nothing is changed if any of them are destructive.
+func Apply(
+	ctx context.Context,
+	js jetstream.JetStream,
+	changes []Change,
+	force bool,
+	timeout time.Duration,
+	logger *slog.Logger,
+) error {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	var destructive []Change
+	for _, change := range changes {
+		if change.Destructive() {
+			destructive = append(destructive, change)
+		}
+	}
+	if len(destructive) > 0 && !force {
+		return fmt.Errorf("%w: %s", ErrDestructiveChanges, describe(destructive))
+	}
+
+	for _, change := range changes {
+		logger.Info("Applying change", "change", change.String(), "destructive", change.Destructive())
+
+		applyCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := change.apply(applyCtx, js)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to %s %s '%s': %w", change.Action, change.Kind, change.Name, err)
+		}
+	}
+	return nil
+}
+
+// Check reports whether JetStream is missing anything from the desired
+// topology, or has it set up differently
+func Check(ctx context.Context, js jetstream.JetStream, desired Topology) error {
+	changes, err := Plan(ctx, js, desired)
+	if err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		return fmt.Errorf("%w: %s", ErrPendingChanges, describe(changes))
+	}
+	return nil
+}
+
+func describe(changes []Change) string {
+	descriptions := make([]string, len(changes))
+	for i, change := range changes {
+		descriptions[i] = change.String()
+	}
+	return strings.Join(descriptions, "; ")
+}
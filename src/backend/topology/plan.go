@@ -0,0 +1,433 @@
+package topology
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+//------------------------------------------------------------------------------
+
+type Kind string
+
+const (
+	KindStream   Kind = "stream"
+	KindBucket   Kind = "bucket"
+	KindConsumer Kind = "consumer"
+	KindVersion  Kind = "version"
+)
+
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	// ActionRecreate deletes & creates the resource, for settings that
+	// JetStream cannot change in place. Anything stored is lost.
+	ActionRecreate Action = "recreate"
+	// ActionDelete removes a consumer that is no longer declared, along with
+	// its progress through the stream
+	ActionDelete Action = "delete"
+)
+
+// Change is a difference between the desired & actual topology, along with how
+// to resolve it
+type Change struct {
+	Kind   Kind
+	Name   string
+	Action Action
+	Diffs  []Diff
+
+	apply func(ctx context.Context, js jetstream.JetStream) error
+}
+
+// Diff is a setting that does not have its desired value
+type Diff struct {
+	Setting string
+	Current any
+	Desired any
+	// Destructive is set when changing the setting loses data, ie. shortening
+	// how long messages are kept
+	Destructive bool
+
+	recreate bool
+}
+
+// Destructive reports whether applying the change loses data
+func (c Change) Destructive() bool {
+	if c.Action == ActionRecreate || c.Action == ActionDelete {
+		return true
+	}
+	for _, diff := range c.Diffs {
+		if diff.Destructive {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%s %s '%s'", c.Action, c.Kind, c.Name)
+	if len(c.Diffs) == 0 {
+		return s
+	}
+
+	diffs := make([]string, len(c.Diffs))
+	for i, diff := range c.Diffs {
+		diffs[i] = fmt.Sprintf("%s %v -> %v", diff.Setting, diff.Current, diff.Desired)
+	}
+	return fmt.Sprintf("%s (%s)", s, strings.Join(diffs, ", "))
+}
+
+//------------------------------------------------------------------------------
+
+// Plan compares the desired topology against JetStream, returning the changes
+// needed to bring JetStream up to date - streams & buckets first, then the
+// consumers on them, then recording the Version migrated to. JetStream that
+// was migrated to a newer version is refused with ErrNewerVersion, rather than
+// rolled back.
+//
+// Only the settings the topology declares are compared. The only things
+// removed are durable consumers that aren't declared, on the streams that the
+// topology declares consumers for (ie. those of partitions that were scaled
+// away), which would otherwise hold on to their pending messages forever.
+func Plan(ctx context.Context, js jetstream.JetStream, desired Topology) ([]Change, error) {
+	var changes []Change
+	// Streams that will be (re)created, which takes their consumers with them
+	created := map[string]bool{}
+
+	for _, cfg := range desired.Streams {
+		cfg := cfg // Captured by the change
+		change, err := planStream(ctx, js, KindStream, cfg, func(ctx context.Context, js jetstream.JetStream) error {
+			_, err := js.CreateStream(ctx, cfg)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+			created[cfg.Name] = change.Action != ActionUpdate
+		}
+	}
+
+	for _, cfg := range desired.Buckets {
+		cfg := cfg // Captured by the change
+		change, err := planStream(ctx, js, KindBucket, bucketStreamConfig(cfg), func(ctx context.Context, js jetstream.JetStream) error {
+			// Sets up the rest of the stream the way KV buckets expect
+			_, err := js.CreateKeyValue(ctx, cfg)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			change.Name = cfg.Bucket
+			changes = append(changes, *change)
+		}
+	}
+
+	for _, consumer := range desired.Consumers {
+		change, err := planConsumer(ctx, js, consumer, created[consumer.Stream])
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+
+	declared := desired.DurableConsumers()
+	for _, cfg := range desired.Streams {
+		if declared[cfg.Name] == nil || created[cfg.Name] {
+			continue
+		}
+		stale, err := planStaleConsumers(ctx, js, cfg.Name, declared[cfg.Name])
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, stale...)
+	}
+
+	if desired.VersionBucket != "" {
+		change, err := planVersion(ctx, js, desired.VersionBucket)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+
+	return changes, nil
+}
+
+func planStream(
+	ctx context.Context,
+	js jetstream.JetStream,
+	kind Kind,
+	desired jetstream.StreamConfig,
+	create func(ctx context.Context, js jetstream.JetStream) error,
+) (*Change, error) {
+	stream, err := js.Stream(ctx, desired.Name)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		return &Change{Kind: kind, Name: desired.Name, Action: ActionCreate, apply: create}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s '%s': %w", kind, desired.Name, err)
+	}
+
+	current := stream.CachedInfo().Config
+	diffs := diffStream(current, desired)
+	if len(diffs) == 0 {
+		return nil, nil
+	}
+
+	change := &Change{
+		Kind:   kind,
+		Name:   desired.Name,
+		Action: ActionUpdate,
+		Diffs:  diffs,
+		apply: func(ctx context.Context, js jetstream.JetStream) error {
+			_, err := js.UpdateStream(ctx, updateStreamConfig(current, desired))
+			return err
+		},
+	}
+	if requiresRecreate(diffs) {
+		change.Action = ActionRecreate
+		change.apply = func(ctx context.Context, js jetstream.JetStream) error {
+			err := js.DeleteStream(ctx, desired.Name)
+			if err != nil {
+				return err
+			}
+			return create(ctx, js)
+		}
+	}
+	return change, nil
+}
+
+func planConsumer(ctx context.Context, js jetstream.JetStream, desired Consumer, streamCreated bool) (*Change, error) {
+	name := desired.Config.Durable
+	create := func(ctx context.Context, js jetstream.JetStream) error {
+		_, err := js.CreateConsumer(ctx, desired.Stream, desired.Config)
+		return err
+	}
+
+	if streamCreated {
+		return &Change{Kind: KindConsumer, Name: name, Action: ActionCreate, apply: create}, nil
+	}
+
+	consumer, err := js.Consumer(ctx, desired.Stream, name)
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return &Change{Kind: KindConsumer, Name: name, Action: ActionCreate, apply: create}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get consumer '%s': %w", name, err)
+	}
+
+	current := consumer.CachedInfo().Config
+	diffs := diffConsumer(current, desired.Config)
+	if len(diffs) == 0 {
+		return nil, nil
+	}
+
+	change := &Change{
+		Kind:   KindConsumer,
+		Name:   name,
+		Action: ActionUpdate,
+		Diffs:  diffs,
+		apply: func(ctx context.Context, js jetstream.JetStream) error {
+			cfg := current
+			cfg.AckWait = desired.Config.AckWait
+			cfg.MaxAckPending = desired.Config.MaxAckPending
+			cfg.MaxDeliver = desired.Config.MaxDeliver
+
+			_, err := js.UpdateConsumer(ctx, desired.Stream, cfg)
+			return err
+		},
+	}
+	if requiresRecreate(diffs) {
+		change.Action = ActionRecreate
+		change.apply = func(ctx context.Context, js jetstream.JetStream) error {
+			err := js.DeleteConsumer(ctx, desired.Stream, name)
+			if err != nil {
+				return err
+			}
+			return create(ctx, js)
+		}
+	}
+	return change, nil
+}
+
+// planStaleConsumers deletes the durable consumers on the stream that aren't
+// declared. Ephemeral consumers (ie. those reading the stream) are left alone.
+func planStaleConsumers(ctx context.Context, js jetstream.JetStream, streamName string, declared map[string]bool) ([]Change, error) {
+	stream, err := js.Stream(ctx, streamName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stream '%s': %w", streamName, err)
+	}
+
+	var changes []Change
+	lister := stream.ListConsumers(ctx)
+	for info := range lister.Info() {
+		name := info.Config.Durable
+		if name == "" || declared[name] {
+			continue
+		}
+		changes = append(changes, Change{
+			Kind:   KindConsumer,
+			Name:   name,
+			Action: ActionDelete,
+			apply: func(ctx context.Context, js jetstream.JetStream) error {
+				return js.DeleteConsumer(ctx, streamName, name)
+			},
+		})
+	}
+	if err := lister.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list consumers of stream '%s': %w", streamName, err)
+	}
+	return changes, nil
+}
+
+//------------------------------------------------------------------------------
+
+// diffStream compares the settings of a stream that the topology declares
+func diffStream(current jetstream.StreamConfig, desired jetstream.StreamConfig) []Diff {
+	var diffs []Diff
+
+	if !slices.Equal(sorted(current.Subjects), sorted(desired.Subjects)) {
+		removed := slices.ContainsFunc(current.Subjects, func(subject string) bool {
+			return !slices.Contains(desired.Subjects, subject)
+		})
+		diffs = append(diffs, Diff{Setting: "subjects", Current: current.Subjects, Desired: desired.Subjects, Destructive: removed})
+	}
+	// Neither can be changed once the stream exists
+	if current.Retention != desired.Retention {
+		diffs = append(diffs, Diff{Setting: "retention", Current: current.Retention, Desired: desired.Retention, recreate: true})
+	}
+	if current.Storage != desired.Storage {
+		diffs = append(diffs, Diff{Setting: "storage", Current: current.Storage, Desired: desired.Storage, recreate: true})
+	}
+	if current.Replicas != desired.Replicas {
+		diffs = append(diffs, Diff{Setting: "replicas", Current: current.Replicas, Desired: desired.Replicas})
+	}
+	if current.MaxAge != desired.MaxAge {
+		diffs = append(diffs, Diff{
+			Setting:     "max_age",
+			Current:     current.MaxAge,
+			Desired:     desired.MaxAge,
+			Destructive: shrinks(int64(current.MaxAge), int64(desired.MaxAge)),
+		})
+	}
+	if current.MaxMsgsPerSubject != desired.MaxMsgsPerSubject {
+		diffs = append(diffs, Diff{
+			Setting:     "max_msgs_per_subject",
+			Current:     current.MaxMsgsPerSubject,
+			Desired:     desired.MaxMsgsPerSubject,
+			Destructive: shrinks(current.MaxMsgsPerSubject, desired.MaxMsgsPerSubject),
+		})
+	}
+	if current.Duplicates != desired.Duplicates {
+		diffs = append(diffs, Diff{Setting: "duplicate_window", Current: current.Duplicates, Desired: desired.Duplicates})
+	}
+	if describeTransform(current.SubjectTransform) != describeTransform(desired.SubjectTransform) {
+		diffs = append(diffs, Diff{
+			Setting: "subject_transform",
+			Current: describeTransform(current.SubjectTransform),
+			Desired: describeTransform(desired.SubjectTransform),
+			// Repartitioning splits the history of every aggregate across two
+			// partitions
+			Destructive: current.SubjectTransform != nil,
+		})
+	}
+
+	return diffs
+}
+
+// diffConsumer compares the settings of a consumer that the topology declares.
+// Recreating a consumer starts it again from the beginning of the stream, so
+// anything that needs one is destructive.
+func diffConsumer(current jetstream.ConsumerConfig, desired jetstream.ConsumerConfig) []Diff {
+	var diffs []Diff
+
+	if current.FilterSubject != desired.FilterSubject {
+		diffs = append(diffs, Diff{Setting: "filter_subject", Current: current.FilterSubject, Desired: desired.FilterSubject, recreate: true})
+	}
+	if current.AckPolicy != desired.AckPolicy {
+		diffs = append(diffs, Diff{Setting: "ack_policy", Current: current.AckPolicy, Desired: desired.AckPolicy, recreate: true})
+	}
+	if current.DeliverPolicy != desired.DeliverPolicy {
+		diffs = append(diffs, Diff{Setting: "deliver_policy", Current: current.DeliverPolicy, Desired: desired.DeliverPolicy, recreate: true})
+	}
+	if current.AckWait != desired.AckWait {
+		diffs = append(diffs, Diff{Setting: "ack_wait", Current: current.AckWait, Desired: desired.AckWait})
+	}
+	if current.MaxAckPending != desired.MaxAckPending {
+		diffs = append(diffs, Diff{Setting: "max_ack_pending", Current: current.MaxAckPending, Desired: desired.MaxAckPending})
+	}
+	if current.MaxDeliver != desired.MaxDeliver {
+		diffs = append(diffs, Diff{Setting: "max_deliver", Current: current.MaxDeliver, Desired: desired.MaxDeliver})
+	}
+
+	return diffs
+}
+
+// updateStreamConfig applies the declared settings to the current config of
+// the stream, leaving the rest as they are
+func updateStreamConfig(current jetstream.StreamConfig, desired jetstream.StreamConfig) jetstream.StreamConfig {
+	cfg := current
+	cfg.Subjects = desired.Subjects
+	cfg.Replicas = desired.Replicas
+	cfg.MaxAge = desired.MaxAge
+	cfg.MaxMsgsPerSubject = desired.MaxMsgsPerSubject
+	cfg.Duplicates = desired.Duplicates
+	cfg.SubjectTransform = desired.SubjectTransform
+	return cfg
+}
+
+// bucketStreamConfig is the stream underlying a KV bucket, laid out the same
+// way as by CreateKeyValue
+func bucketStreamConfig(cfg jetstream.KeyValueConfig) jetstream.StreamConfig {
+	duplicates := 2 * time.Minute
+	if cfg.TTL > 0 {
+		duplicates = min(duplicates, cfg.TTL)
+	}
+
+	return jetstream.StreamConfig{
+		Name:              fmt.Sprintf("KV_%s", cfg.Bucket),
+		Subjects:          []string{fmt.Sprintf("$KV.%s.>", cfg.Bucket)},
+		Retention:         jetstream.LimitsPolicy,
+		MaxAge:            cfg.TTL,
+		MaxMsgsPerSubject: int64(max(cfg.History, 1)),
+		Storage:           cfg.Storage,
+		Replicas:          max(cfg.Replicas, 1),
+		Duplicates:        duplicates,
+	}
+}
+
+func describeTransform(transform *jetstream.SubjectTransformConfig) string {
+	if transform == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%s -> %s", transform.Source, transform.Destination)
+}
+
+func requiresRecreate(diffs []Diff) bool {
+	return slices.ContainsFunc(diffs, func(diff Diff) bool { return diff.recreate })
+}
+
+// shrinks reports whether a limit is lowered, where 0 or less is unlimited
+func shrinks(current int64, desired int64) bool {
+	return desired > 0 && (current <= 0 || desired < current)
+}
+
+func sorted(values []string) []string {
+	values = slices.Clone(values)
+	slices.Sort(values)
+	return values
+}
@@ -0,0 +1,96 @@
+package topology_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"nats_cqrs/natstest"
+	"nats_cqrs/topology"
+)
+
+//------------------------------------------------------------------------------
+
+// The consumers of partitions that were scaled away are deleted, but only when
+// forced, as their progress is lost along with them
+func TestPlanDeletesStaleConsumers(t *testing.T) {
+	s := natstest.RunServer(t)
+	cfg := natstest.Config(s)
+	cfg.Reactor.Partitions = 2
+	_, js := natstest.Connect(t, s)
+	natstest.Migrate(t, js, cfg)
+
+	ctx := context.Background()
+	cfg.Reactor.Partitions = 1
+	changes, err := topology.Plan(ctx, js, topology.Desired(cfg))
+	if err != nil {
+		t.Fatalf("failed to plan: %v", err)
+	}
+
+	var deleted []string
+	for _, change := range changes {
+		if change.Action == topology.ActionDelete {
+			deleted = append(deleted, change.Name)
+		}
+	}
+	slices.Sort(deleted)
+	expected := []string{
+		topology.ConsumerName(cfg.Reactor.CommandsConsumer, 1),
+		topology.ConsumerName(cfg.Reactor.ProjectorConsumer, 1),
+	}
+	slices.Sort(expected)
+	if !slices.Equal(deleted, expected) {
+		t.Fatalf("expected %v to be deleted, got %v", expected, deleted)
+	}
+
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	err = topology.Apply(ctx, js, changes, false, time.Second, quiet)
+	if !errors.Is(err, topology.ErrDestructiveChanges) {
+		t.Fatalf("expected the changes to be refused without forcing, got %v", err)
+	}
+	err = topology.Apply(ctx, js, changes, true, time.Second, quiet)
+	if err != nil {
+		t.Fatalf("failed to apply: %v", err)
+	}
+
+	err = topology.Check(ctx, js, topology.Desired(cfg))
+	if err != nil {
+		t.Fatalf("expected the topology to be up to date: %v", err)
+	}
+}
+
+// Migrating records the version, and JetStream migrated by a newer build is
+// refused rather than rolled back
+func TestPlanRefusesNewerVersion(t *testing.T) {
+	s := natstest.RunServer(t)
+	cfg := natstest.Config(s)
+	_, js := natstest.Connect(t, s)
+	natstest.Migrate(t, js, cfg)
+
+	ctx := context.Background()
+	kv, err := js.KeyValue(ctx, cfg.Buckets.Topology)
+	if err != nil {
+		t.Fatalf("failed to look up topology bucket: %v", err)
+	}
+	entry, err := kv.Get(ctx, "version")
+	if err != nil {
+		t.Fatalf("expected the version to be recorded: %v", err)
+	}
+	if version := string(entry.Value()); version != strconv.Itoa(topology.Version) {
+		t.Fatalf("expected version %d to be recorded, got %s", topology.Version, version)
+	}
+
+	_, err = kv.Put(ctx, "version", []byte(strconv.Itoa(topology.Version+1)))
+	if err != nil {
+		t.Fatalf("failed to record newer version: %v", err)
+	}
+	_, err = topology.Plan(ctx, js, topology.Desired(cfg))
+	if !errors.Is(err, topology.ErrNewerVersion) {
+		t.Fatalf("expected the newer version to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+// Package topology declares the JetStream streams, KV buckets & durable
+// consumers that the server & reactor rely on.
+//
+// The services never create them - they only check that JetStream matches the
+// topology, and refuse to start otherwise. It is brought up to date by the
+// `migrate` command, which plans the changes needed & applies them, then
+// records the Version it migrated to.
+package topology
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"nats_cqrs/config"
+	"nats_cqrs/shared"
+)
+
+//------------------------------------------------------------------------------
+
+type Topology struct {
+	Streams   []jetstream.StreamConfig
+	Buckets   []jetstream.KeyValueConfig
+	Consumers []Consumer
+	// VersionBucket is one of the buckets, which records the Version that was
+	// last migrated to
+	VersionBucket string
+}
+
+// Consumer is a durable consumer on one of the streams
+type Consumer struct {
+	Stream string
+	Config jetstream.ConsumerConfig
+}
+
+// Desired is the topology described by the config
+func Desired(cfg *config.Config) Topology {
+	storage := jetstream.FileStorage
+	if cfg.Streams.Storage == "memory" {
+		storage = jetstream.MemoryStorage
+	}
+
+	stream := func(name string, subject string, maxAge time.Duration, transform *jetstream.SubjectTransformConfig) jetstream.StreamConfig {
+		duplicates := cfg.Streams.DuplicateWindow
+		if maxAge > 0 {
+			// The server refuses a duplicate window longer than the max age
+			duplicates = min(duplicates, maxAge)
+		}
+
+		return jetstream.StreamConfig{
+			Name:              name,
+			Subjects:          []string{fmt.Sprintf("%s.>", subject)},
+			Retention:         jetstream.LimitsPolicy,
+			Discard:           jetstream.DiscardOld,
+			MaxAge:            maxAge,
+			MaxMsgs:           -1,
+			MaxBytes:          -1,
+			MaxMsgsPerSubject: -1,
+			Storage:           storage,
+			Replicas:          cfg.Streams.Replicas,
+			Duplicates:        duplicates,
+			SubjectTransform:  transform,
+		}
+	}
+
+	bucket := func(name string, history uint8, ttl time.Duration) jetstream.KeyValueConfig {
+		return jetstream.KeyValueConfig{
+			Bucket:   name,
+			History:  history,
+			TTL:      ttl,
+			Storage:  storage,
+			Replicas: cfg.Streams.Replicas,
+		}
+	}
+
+	topology := Topology{
+		Streams: []jetstream.StreamConfig{
+			// `commands.<id>.<command>` is stored as
+			// `commands.<partition>.<id>.<command>`...
+			stream(cfg.Streams.Commands, shared.StreamSubjectCommands, 0, partitionTransform(shared.StreamSubjectCommands, 2, cfg.Reactor.Partitions)),
+			// ...and `events.<id>` as `events.<partition>.<id>`
+			stream(cfg.Streams.Events, shared.StreamSubjectEvents, 0, partitionTransform(shared.StreamSubjectEvents, 1, cfg.Reactor.Partitions)),
+			// Messages that could not be handled are kept for operators to
+			// inspect & replay
+			stream(cfg.Streams.DeadLetter, shared.StreamSubjectDeadLetter, cfg.Streams.DeadLetterMaxAge, nil),
+			// Notifications are kept for a while so that SSE clients can catch
+			// up on anything they missed while disconnected
+			stream(cfg.Streams.Notifications, shared.StreamSubjectNotifications, cfg.Streams.NotificationsMaxAge, nil),
+		},
+		Buckets: []jetstream.KeyValueConfig{
+			bucket(cfg.Buckets.Locations, cfg.Buckets.LocationsHistory, 0),
+			bucket(cfg.Buckets.LocationNames, 1, 0),
+			bucket(cfg.Buckets.IdempotencyKeys, 1, cfg.Buckets.IdempotencyKeyTTL),
+			bucket(cfg.Buckets.ReadModels, 1, 0),
+			bucket(cfg.Buckets.Projections, 1, cfg.Buckets.ProjectionsTTL),
+			bucket(cfg.Buckets.Topology, 1, 0),
+		},
+		VersionBucket: cfg.Buckets.Topology,
+	}
+
+	// Every partition has its own durable consumers, which the reactor
+	// instances share out between them
+	for partition := 0; partition < max(cfg.Reactor.Partitions, 1); partition++ {
+		consumer := func(stream string, name string, subject string) Consumer {
+			name = ConsumerName(name, partition)
+			return Consumer{
+				Stream: stream,
+				Config: jetstream.ConsumerConfig{
+					Name:          name,
+					Durable:       name,
+					AckPolicy:     jetstream.AckExplicitPolicy,
+					DeliverPolicy: jetstream.DeliverAllPolicy,
+					FilterSubject: PartitionSubject(subject, partition),
+					AckWait:       cfg.Reactor.Consumer.AckWait,
+					MaxAckPending: cfg.Reactor.Consumer.MaxInFlight,
+					MaxDeliver:    cfg.Reactor.Consumer.MaxDeliver,
+				},
+			}
+		}
+
+		topology.Consumers = append(
+			topology.Consumers,
+			consumer(cfg.Streams.Commands, cfg.Reactor.CommandsConsumer, shared.StreamSubjectCommands),
+			consumer(cfg.Streams.Events, cfg.Reactor.ProjectorConsumer, shared.StreamSubjectEvents),
+		)
+	}
+
+	return topology
+}
+
+// partitionTransform stores the messages published on `<subject>.<id>...`
+// (with the given number of tokens after the subject) as
+// `<subject>.<partition>.<id>...`, partitioning them by aggregate id
+func partitionTransform(subject string, tokens int, partitions int) *jetstream.SubjectTransformConfig {
+	source := subject
+	destination := fmt.Sprintf("%s.{{partition(%d,1)}}", subject, max(partitions, 1))
+	for token := 1; token <= tokens; token++ {
+		source += ".*"
+		destination += fmt.Sprintf(".{{wildcard(%d)}}", token)
+	}
+	return &jetstream.SubjectTransformConfig{Source: source, Destination: destination}
+}
+
+// PartitionSubject is the subject of every message in a partition of the
+// stream
+func PartitionSubject(subject string, partition int) string {
+	return fmt.Sprintf("%s.%d.>", subject, partition)
+}
+
+// ConsumerName is the name of the durable consumer for a partition
+func ConsumerName(name string, partition int) string {
+	return fmt.Sprintf("%s-%d", name, partition)
+}
+
+// InstancePartitions are the partitions that a reactor instance consumes -
+// every instances-th one, so that each partition is consumed by one instance
+func InstancePartitions(partitions int, instances int, instance int) []int {
+	owned := []int{}
+	for partition := instance; partition < partitions; partition += max(instances, 1) {
+		owned = append(owned, partition)
+	}
+	return owned
+}
+
+// DurableConsumers are the names of the declared durable consumers, by stream
+func (t Topology) DurableConsumers() map[string]map[string]bool {
+	durables := map[string]map[string]bool{}
+	for _, consumer := range t.Consumers {
+		if durables[consumer.Stream] == nil {
+			durables[consumer.Stream] = map[string]bool{}
+		}
+		durables[consumer.Stream][consumer.Config.Durable] = true
+	}
+	return durables
+}
+
+// WithoutConsumers is the topology without any consumers, for processes that
+// don't consume from durable consumers
+func (t Topology) WithoutConsumers() Topology {
+	t.Consumers = nil
+	return t
+}
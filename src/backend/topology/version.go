@@ -0,0 +1,79 @@
+package topology
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+//------------------------------------------------------------------------------
+
+// Version of the topology declared by Desired. It is bumped whenever the
+// services come to rely on something that the settings alone don't show (ie.
+// how a stream's subjects are laid out), so that they refuse to run against
+// JetStream migrated by an older or newer build.
+const Version = 1
+
+// versionKey is the key of the version bucket holding the migrated version
+const versionKey = "version"
+
+var ErrNewerVersion = errors.New("topology was migrated to a newer version")
+
+// planVersion records the Version, once everything else has been migrated.
+// The bucket may not exist yet, if it is created by the same migration.
+func planVersion(ctx context.Context, js jetstream.JetStream, bucket string) (*Change, error) {
+	current, err := migratedVersion(ctx, js, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if current > Version {
+		return nil, fmt.Errorf("%w: %d, while this build declares %d", ErrNewerVersion, current, Version)
+	}
+	if current == Version {
+		return nil, nil
+	}
+
+	return &Change{
+		Kind:   KindVersion,
+		Name:   bucket,
+		Action: ActionUpdate,
+		Diffs:  []Diff{{Setting: "version", Current: current, Desired: Version}},
+		apply: func(ctx context.Context, js jetstream.JetStream) error {
+			kv, err := js.KeyValue(ctx, bucket)
+			if err != nil {
+				return err
+			}
+			_, err = kv.Put(ctx, versionKey, []byte(strconv.Itoa(Version)))
+			return err
+		},
+	}, nil
+}
+
+// migratedVersion is the version recorded in the bucket, which is 0 if nothing
+// was recorded yet
+func migratedVersion(ctx context.Context, js jetstream.JetStream, bucket string) (int, error) {
+	kv, err := js.KeyValue(ctx, bucket)
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up bucket '%s': %w", bucket, err)
+	}
+
+	entry, err := kv.Get(ctx, versionKey)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up topology version: %w", err)
+	}
+
+	version, err := strconv.Atoi(string(entry.Value()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode topology version: %w", err)
+	}
+	return version, nil
+}
@@ -5,20 +5,27 @@ import { Controls } from "./page";
 
 type Notification = any;
 
-function waitForNotification(timeout: number): Promise<Notification> {
+function waitForNotification(
+  commandId: string,
+  streamToken: string,
+  timeout: number,
+): Promise<Notification> {
   const eventSource = new EventSource(
-    "http://localhost:3001/api/notifications?stream=notifications",
+    `http://localhost:3001/api/notifications?command=${encodeURIComponent(commandId)}&token=${encodeURIComponent(streamToken)}`,
   );
 
   const ac = new AbortController();
 
-  eventSource.addEventListener(
-    "notification",
-    (msg) => {
-      ac.abort(msg.data);
-    },
-    { once: true, signal: ac.signal },
-  );
+  // Failed commands are sent as a separate event type
+  for (const type of ["notification", "notification-failed"]) {
+    eventSource.addEventListener(
+      type,
+      (msg) => {
+        ac.abort(msg.data);
+      },
+      { once: true, signal: ac.signal },
+    );
+  }
 
   eventSource.onerror = (event) => {
     console.error("[Eventsource] Errored", { event });
@@ -72,8 +79,10 @@ export function CreateLocationForm({
     headers.set("X-Notification-Await", awaitOnServer.toString());
     headers.set("X-Notification-Timeout", notificationTimeout.toString());
     headers.set("X-Notification-Simulate-Timeout", simulateTimeout.toString());
+    // Retrying the same submission must not create a second location
+    headers.set("Idempotency-Key", crypto.randomUUID());
 
-    const res = await betterFetch<{ id: string }>(
+    const res = await betterFetch<{ id: string; stream_token: string }>(
       "http://localhost:3001/api/location/create",
       {
         method: "POST",
@@ -123,7 +132,11 @@ export function CreateLocationForm({
       return;
     }
 
-    const notification = await waitForNotification(notificationTimeout * 1_000)
+    const notification = await waitForNotification(
+      res.data.id,
+      res.data.stream_token,
+      notificationTimeout * 1_000,
+    )
       .then((msg) => {
         const json = JSON.parse(msg);
         console.log(
@@ -131,6 +144,21 @@ export function CreateLocationForm({
           JSON.stringify(json, null, 2),
         );
 
+        if (json.errors?.length > 0) {
+          const message = json.actions?.find(
+            (action: any) => action.type === "show-message",
+          )?.data;
+
+          toast.error(
+            <>
+              Something went wrong <br />
+              <b>{message ?? json.errors[0].message}</b>
+            </>,
+          );
+
+          return json;
+        }
+
         toast.success(
           <>
             <h2>Success!</h2>